@@ -0,0 +1,131 @@
+package packstream
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// encoderPool holds the encoders used by AppendMarshal.
+var encoderPool = sync.Pool{
+	New: func() interface{} { return &Encoder{buffered: true} },
+}
+
+// AppendMarshal appends the packstream encoding of v to dst, and returns the extended buffer. If the encoding fails,
+// it returns dst unchanged, along with the error.
+// See the documentation for Marshal for details about the conversion of Go values to packstream.
+//
+// When dst has enough capacity, AppendMarshal does not allocate, except for Go maps and for Marshaler values.
+func AppendMarshal(dst []byte, v interface{}) ([]byte, error) {
+	return appendMarshal(dst, v, false)
+}
+
+// appendMarshal appends the packstream encoding of v to dst, sorting the map keys if sortMapKeys is true.
+// If the encoding fails, dst is returned without any partial encoding appended.
+func appendMarshal(dst []byte, v interface{}, sortMapKeys bool) ([]byte, error) {
+	e := encoderPool.Get().(*Encoder)
+	e.buf = dst
+	e.sortKeys = sortMapKeys
+	err := e.Encode(v)
+	if err == nil {
+		dst = e.buf
+	}
+	e.buf = nil
+	e.streams = 0
+	encoderPool.Put(e)
+	return dst, err
+}
+
+// AppendNull appends a packstream null to dst.
+func AppendNull(dst []byte) []byte {
+	return append(dst, mNull)
+}
+
+// AppendBool appends a packstream boolean to dst.
+func AppendBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, mTrue)
+	}
+	return append(dst, mFalse)
+}
+
+// AppendInt appends a packstream integer to dst, using the smallest representation which can hold n.
+func AppendInt(dst []byte, n int64) []byte {
+	switch {
+	case minTinyInt <= n && n <= math.MaxInt8:
+		return append(dst, byte(n))
+	case math.MinInt8 <= n && n < minTinyInt:
+		return append(dst, mInt8, byte(n))
+	case math.MinInt16 <= n && n <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(dst, mInt16), uint16(n))
+	case math.MinInt32 <= n && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(dst, mInt32), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, mInt64), uint64(n))
+}
+
+// AppendFloat appends a packstream float to dst.
+func AppendFloat(dst []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, mFloat64), math.Float64bits(f))
+}
+
+// AppendString appends a packstream string to dst.
+// It returns ErrMarshalValueTooLarge if s is too large for packstream encoding.
+func AppendString(dst []byte, s string) ([]byte, error) {
+	dst, err := appendHeader(dst, len(s), tinyStringSizes, mStringSize8, mStringSize16, mStringSize32)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, s...), nil
+}
+
+// AppendBytes appends a packstream byte array to dst.
+// It returns ErrMarshalValueTooLarge if p is too large for packstream encoding.
+func AppendBytes(dst []byte, p []byte) ([]byte, error) {
+	dst, err := appendHeader(dst, len(p), nil, mBytesSize8, mBytesSize16, mBytesSize32)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, p...), nil
+}
+
+// AppendListHeader appends to dst the header of a list of n elements, which must then be appended.
+func AppendListHeader(dst []byte, n int) ([]byte, error) {
+	return appendHeader(dst, n, tinyListSizes, mListSize8, mListSize16, mListSize32)
+}
+
+// AppendMapHeader appends to dst the header of a map of n entries, which must then be appended, each of them being
+// a string key followed by its value.
+func AppendMapHeader(dst []byte, n int) ([]byte, error) {
+	return appendHeader(dst, n, tinyMapSizes, mMapSize8, mMapSize16, mMapSize32)
+}
+
+// AppendStructHeader appends to dst the header of a structure of n fields, with the given signature. The n fields
+// must then be appended.
+func AppendStructHeader(dst []byte, n int, sig byte) ([]byte, error) {
+	dst, err := appendHeader(dst, n, tinyStructSizes, mStructSize8, mStructSize16, 0)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, sig), nil
+}
+
+// appendHeader appends the marker and the size of a sized value of n elements. Sizes lower than 16 are packed with
+// the tiny markers, unless tiny is nil. Larger sizes are written after the m8, m16 or m32 marker, unless m32 is 0.
+func appendHeader(dst []byte, n int, tiny [][]byte, m8, m16, m32 byte) ([]byte, error) {
+	switch u := uint64(n); {
+	case tiny != nil && u < maxInt4:
+		return append(dst, tiny[n]...), nil
+	case u <= math.MaxUint8:
+		return append(append(dst, m8), packedUint8Sizes[n]...), nil
+	case u <= math.MaxUint16:
+		return append(append(dst, m16), packedUint16Sizes[n]...), nil
+	case m32 != 0 && u <= math.MaxUint32:
+		return append(dst, m32, byte(u>>24), byte(u>>16), byte(u>>8), byte(u)), nil
+	}
+	return dst, ErrMarshalValueTooLarge
+}
+
+// marshalerType is the type of the Marshaler interface.
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
@@ -0,0 +1,80 @@
+package packstream
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+
+	tests := []struct {
+		append func([]byte) ([]byte, error)
+		write  func() error
+	}{
+		{func(p []byte) ([]byte, error) { return AppendNull(p), nil }, enc.WriteNull},
+		{func(p []byte) ([]byte, error) { return AppendBool(p, true), nil }, func() error { return enc.WriteBool(true) }},
+		{func(p []byte) ([]byte, error) { return AppendInt(p, -17), nil }, func() error { return enc.WriteInt(-17) }},
+		{func(p []byte) ([]byte, error) { return AppendInt(p, math.MinInt64), nil }, func() error { return enc.WriteInt(math.MinInt64) }},
+		{func(p []byte) ([]byte, error) { return AppendFloat(p, 1.1), nil }, func() error { return enc.WriteFloat(1.1) }},
+		{func(p []byte) ([]byte, error) { return AppendString(p, "hello") }, func() error { return enc.WriteString("hello") }},
+		{func(p []byte) ([]byte, error) { return AppendBytes(p, make([]byte, 300)) }, func() error { return enc.WriteBytes(make([]byte, 300)) }},
+		{func(p []byte) ([]byte, error) { return AppendListHeader(p, 70000) }, func() error { return enc.WriteListHeader(70000) }},
+		{func(p []byte) ([]byte, error) { return AppendMapHeader(p, 16) }, func() error { return enc.WriteMapHeader(16) }},
+		{func(p []byte) ([]byte, error) { return AppendStructHeader(p, 3, 0x4E) }, func() error { return enc.WriteStructHeader(3, 0x4E) }},
+	}
+	for i, test := range tests {
+		b.Reset()
+		test.write()
+		if p, err := test.append([]byte{0xFF}); err != nil {
+			t.Errorf("test %v: unexpected error: %v", i, err)
+		} else if !bytes.Equal(p[1:], b.Bytes()) || p[0] != 0xFF {
+			t.Errorf("test %v: got % #X, expected % #X", i, p[1:], b.Bytes())
+		}
+	}
+
+	if _, err := AppendListHeader(nil, -1); err != ErrMarshalValueTooLarge {
+		t.Errorf("error should be ErrMarshalValueTooLarge, got %v", err)
+	}
+	if _, err := AppendStructHeader(nil, math.MaxUint16+1, 0x01); err != ErrMarshalValueTooLarge {
+		t.Errorf("error should be ErrMarshalValueTooLarge, got %v", err)
+	}
+}
+
+func TestAppendMarshal(t *testing.T) {
+	v := []interface{}{int64(1000), "hello", testStruct{Name: "a", Count: 2}, Node{ID: 1, Labels: []string{"A"}}}
+	encoded, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := AppendMarshal([]byte{0xFF}, v); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(p[1:], encoded) || p[0] != 0xFF {
+		t.Errorf("invalid appended value, got % #X, expected % #X", p[1:], encoded)
+	}
+	if _, err := AppendMarshal(nil, make(chan<- int)); err == nil {
+		t.Error("appending an unsupported value should fail")
+	}
+	if p, err := AppendMarshal([]byte{0xFF}, []interface{}{1, 2, testFailingMarshaler{}}); err == nil {
+		t.Error("appending a failing value should fail")
+	} else if !bytes.Equal(p, []byte{0xFF}) {
+		t.Errorf("a failing value should not be appended, got % #X", p)
+	}
+}
+
+func TestAppend_Allocs(t *testing.T) {
+	var v interface{} = []interface{}{int64(1000), "hello", 1.5, nil, testStruct{Name: "a", Count: 2}, Node{ID: 1, Labels: []string{"A"}}}
+	p := make([]byte, 0, 256)
+	allocs := testing.AllocsPerRun(100, func() {
+		p = AppendInt(p[:0], math.MaxInt32)
+		p, _ = AppendString(p, "key")
+		p, _ = AppendListHeader(p, 20)
+		p = AppendFloat(AppendBool(AppendNull(p), true), 1.1)
+		p, _ = AppendMarshal(p, v)
+	})
+	if allocs != 0 {
+		t.Errorf("appending values should not allocate, got %v allocations", allocs)
+	}
+}
@@ -0,0 +1,399 @@
+/*
+Package bolt defines the messages of the Bolt protocol, used to communicate with Neo4j, as Go structs encoded as
+packstream structures.
+
+Messages are written with Encode and read with Decode, usually through the chunked framing of
+packstream.ChunkWriter and packstream.ChunkReader.
+
+The messages of Bolt versions 1 to 4 are supported. Messages which changed shape across versions, such as Init and
+Hello, or PullAll and Pull, share their signature and are told apart by their number of fields.
+*/
+package bolt
+
+import (
+	"errors"
+	"reflect"
+
+	"gopkg.in/packstream.v1"
+)
+
+// Signatures of the Bolt messages.
+const (
+	SigInit       = 0x01
+	SigHello      = 0x01
+	SigGoodbye    = 0x02
+	SigAckFailure = 0x0E
+	SigReset      = 0x0F
+	SigRun        = 0x10
+	SigBegin      = 0x11
+	SigCommit     = 0x12
+	SigRollback   = 0x13
+	SigDiscardAll = 0x2F
+	SigDiscard    = 0x2F
+	SigPullAll    = 0x3F
+	SigPull       = 0x3F
+	SigSuccess    = 0x70
+	SigRecord     = 0x71
+	SigIgnored    = 0x7E
+	SigFailure    = 0x7F
+)
+
+// ErrUnknownMessage is returned by Decode when the signature of a structure is not the one of a Bolt message.
+var ErrUnknownMessage = errors.New("bolt: unknown message signature")
+
+// ErrFieldCount is returned by Decode when a message does not have the expected number of fields.
+var ErrFieldCount = errors.New("bolt: invalid message field count")
+
+// Message is the interface implemented by the Bolt messages. Signature returns the signature of the message, whose
+// fields are the exported fields of the Go struct, in declaration order.
+type Message interface {
+	Signature() byte
+}
+
+// Init initializes a connection, in Bolt versions 1 and 2. A nil auth token is encoded as an empty map.
+type Init struct {
+	ClientName string
+	AuthToken  map[string]interface{}
+}
+
+// Hello initializes a connection, in Bolt version 3 and later. It shares its signature with Init, from which it
+// differs by its number of fields. Nil extra metadata is encoded as an empty map.
+type Hello struct {
+	Extra map[string]interface{}
+}
+
+// Goodbye announces the end of a connection.
+type Goodbye struct{}
+
+// AckFailure acknowledges a failure.
+type AckFailure struct{}
+
+// Reset resets a connection, discarding pending results and failures.
+type Reset struct{}
+
+// Run runs a statement with its parameters. Nil parameters are encoded as an empty map.
+//
+// Extra holds the metadata of the statement, such as its bookmarks or its transaction timeout, in Bolt version 3 and
+// later. Run is encoded with this third field only if Extra is not nil, as in Bolt versions 1 and 2 otherwise.
+type Run struct {
+	Statement  string
+	Parameters map[string]interface{}
+	Extra      map[string]interface{}
+}
+
+// Begin begins an explicit transaction, in Bolt version 3 and later. Nil extra metadata is encoded as an empty map.
+type Begin struct {
+	Extra map[string]interface{}
+}
+
+// Commit commits an explicit transaction, in Bolt version 3 and later.
+type Commit struct{}
+
+// Rollback rolls back an explicit transaction, in Bolt version 3 and later.
+type Rollback struct{}
+
+// DiscardAll discards all the records of the result of a statement, in Bolt versions 1 to 3.
+type DiscardAll struct{}
+
+// Discard discards records of the result of a statement, in Bolt version 4 and later. Extra holds the number of
+// records to discard and the id of the statement. It shares its signature with DiscardAll, from which it differs by
+// its number of fields. Nil extra metadata is encoded as an empty map.
+type Discard struct {
+	Extra map[string]interface{}
+}
+
+// PullAll requests all the records of the result of a statement, in Bolt versions 1 to 3.
+type PullAll struct{}
+
+// Pull requests records of the result of a statement, in Bolt version 4 and later. Extra holds the number of records
+// to pull and the id of the statement. It shares its signature with PullAll, from which it differs by its number of
+// fields. Nil extra metadata is encoded as an empty map.
+type Pull struct {
+	Extra map[string]interface{}
+}
+
+// Success is the summary of a request which succeeded. Nil metadata is encoded as an empty map.
+type Success struct {
+	Metadata map[string]interface{}
+}
+
+// Record is a record of the result of a statement. Nil fields are encoded as an empty list.
+type Record struct {
+	Fields []interface{}
+}
+
+// Ignored is the summary of a request which was ignored, because of a previous failure.
+type Ignored struct{}
+
+// Failure is the summary of a request which failed. Its metadata holds the code and message of the failure. Nil
+// metadata is encoded as an empty map.
+type Failure struct {
+	Metadata map[string]interface{}
+}
+
+// Signature implements Message.
+func (Init) Signature() byte { return SigInit }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Init) EncodePS(enc *packstream.Encoder) error {
+	if err := enc.WriteStructHeader(2, SigInit); err != nil {
+		return err
+	}
+	if err := enc.WriteString(m.ClientName); err != nil {
+		return err
+	}
+	return encodeMap(enc, m.AuthToken)
+}
+
+// Signature implements Message.
+func (Hello) Signature() byte { return SigHello }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Hello) EncodePS(enc *packstream.Encoder) error {
+	if err := enc.WriteStructHeader(1, SigHello); err != nil {
+		return err
+	}
+	return encodeMap(enc, m.Extra)
+}
+
+// Signature implements Message.
+func (Goodbye) Signature() byte { return SigGoodbye }
+
+// Signature implements Message.
+func (AckFailure) Signature() byte { return SigAckFailure }
+
+// Signature implements Message.
+func (Reset) Signature() byte { return SigReset }
+
+// Signature implements Message.
+func (Run) Signature() byte { return SigRun }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Run) EncodePS(enc *packstream.Encoder) error {
+	n := 2
+	if m.Extra != nil {
+		n = 3
+	}
+	if err := enc.WriteStructHeader(n, SigRun); err != nil {
+		return err
+	}
+	if err := enc.WriteString(m.Statement); err != nil {
+		return err
+	}
+	if err := encodeMap(enc, m.Parameters); err != nil || m.Extra == nil {
+		return err
+	}
+	return enc.Encode(m.Extra)
+}
+
+// Signature implements Message.
+func (Begin) Signature() byte { return SigBegin }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Begin) EncodePS(enc *packstream.Encoder) error {
+	if err := enc.WriteStructHeader(1, SigBegin); err != nil {
+		return err
+	}
+	return encodeMap(enc, m.Extra)
+}
+
+// Signature implements Message.
+func (Commit) Signature() byte { return SigCommit }
+
+// Signature implements Message.
+func (Rollback) Signature() byte { return SigRollback }
+
+// Signature implements Message.
+func (DiscardAll) Signature() byte { return SigDiscardAll }
+
+// Signature implements Message.
+func (Discard) Signature() byte { return SigDiscard }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Discard) EncodePS(enc *packstream.Encoder) error {
+	if err := enc.WriteStructHeader(1, SigDiscard); err != nil {
+		return err
+	}
+	return encodeMap(enc, m.Extra)
+}
+
+// Signature implements Message.
+func (PullAll) Signature() byte { return SigPullAll }
+
+// Signature implements Message.
+func (Pull) Signature() byte { return SigPull }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Pull) EncodePS(enc *packstream.Encoder) error {
+	if err := enc.WriteStructHeader(1, SigPull); err != nil {
+		return err
+	}
+	return encodeMap(enc, m.Extra)
+}
+
+// encodeMap encodes the metadata or parameters m of a message, encoding a nil map as an empty map, as expected by
+// the servers.
+func encodeMap(enc *packstream.Encoder, m map[string]interface{}) error {
+	if m == nil {
+		return enc.WriteMapHeader(0)
+	}
+	return enc.Encode(m)
+}
+
+// Signature implements Message.
+func (Success) Signature() byte { return SigSuccess }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Success) EncodePS(enc *packstream.Encoder) error {
+	if err := enc.WriteStructHeader(1, SigSuccess); err != nil {
+		return err
+	}
+	return encodeMap(enc, m.Metadata)
+}
+
+// Signature implements Message.
+func (Record) Signature() byte { return SigRecord }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Record) EncodePS(enc *packstream.Encoder) error {
+	if err := enc.WriteStructHeader(1, SigRecord); err != nil {
+		return err
+	}
+	if m.Fields == nil {
+		return enc.WriteListHeader(0)
+	}
+	return enc.Encode(m.Fields)
+}
+
+// Signature implements Message.
+func (Ignored) Signature() byte { return SigIgnored }
+
+// Signature implements Message.
+func (Failure) Signature() byte { return SigFailure }
+
+// EncodePS implements packstream.StreamMarshaler.
+func (m Failure) EncodePS(enc *packstream.Encoder) error {
+	if err := enc.WriteStructHeader(1, SigFailure); err != nil {
+		return err
+	}
+	return encodeMap(enc, m.Metadata)
+}
+
+// Encode writes the message m with enc.
+func Encode(enc *packstream.Encoder, m Message) error {
+	return enc.Encode(m)
+}
+
+// Decode reads the next message with dec, and returns a pointer to it.
+//
+// It returns ErrUnknownMessage if the signature of the structure is not the one of a Bolt message, and ErrFieldCount
+// if the structure does not have the number of fields of the message. In both cases, the structure is skipped.
+//
+// The whole message is decoded as a single value, within the limits of dec. The path of a decoding error starts with
+// the name of the message field, such as "Parameters.a".
+func Decode(dec *packstream.Decoder) (Message, error) {
+	var msg message
+	if err := dec.Decode(&msg); err != nil {
+		return nil, err
+	}
+	return msg.m, nil
+}
+
+// message decodes any Bolt message, as a packstream.StreamUnmarshaler.
+type message struct {
+	m Message
+}
+
+// DecodePS implements packstream.StreamUnmarshaler.
+func (msg *message) DecodePS(dec *packstream.Decoder) error {
+	n, sig, err := dec.ReadStructHeader()
+	if err != nil {
+		return err
+	}
+
+	var (
+		m        Message
+		optional int
+	)
+	switch sig {
+	case SigInit:
+		if n == 1 {
+			m = &Hello{}
+		} else {
+			m = &Init{}
+		}
+	case SigGoodbye:
+		m = &Goodbye{}
+	case SigAckFailure:
+		m = &AckFailure{}
+	case SigReset:
+		m = &Reset{}
+	case SigRun:
+		// Extra is only sent from Bolt version 3.
+		m, optional = &Run{}, 1
+	case SigBegin:
+		m = &Begin{}
+	case SigCommit:
+		m = &Commit{}
+	case SigRollback:
+		m = &Rollback{}
+	case SigDiscardAll:
+		if n == 1 {
+			m = &Discard{}
+		} else {
+			m = &DiscardAll{}
+		}
+	case SigPullAll:
+		if n == 1 {
+			m = &Pull{}
+		} else {
+			m = &PullAll{}
+		}
+	case SigSuccess:
+		m = &Success{}
+	case SigRecord:
+		m = &Record{}
+	case SigIgnored:
+		m = &Ignored{}
+	case SigFailure:
+		m = &Failure{}
+	default:
+		return skip(dec, n, ErrUnknownMessage)
+	}
+
+	rv := reflect.ValueOf(m).Elem()
+	if n > rv.NumField() || n < rv.NumField()-optional {
+		return skip(dec, n, ErrFieldCount)
+	}
+	for i := 0; i < n; i++ {
+		if err = dec.Decode(rv.Field(i).Addr().Interface()); err != nil {
+			return fieldError(err, rv.Type().Field(i).Name)
+		}
+	}
+	msg.m = m
+	return nil
+}
+
+// fieldError prefixes the path of err with the name of the message field being decoded, if err is a
+// packstream.UnmarshalTypeError.
+func fieldError(err error, name string) error {
+	var te *packstream.UnmarshalTypeError
+	if errors.As(err, &te) {
+		if te.Path == "" || te.Path[0] == '[' {
+			te.Path = name + te.Path
+		} else {
+			te.Path = name + "." + te.Path
+		}
+	}
+	return err
+}
+
+// skip skips the n fields of a structure, and returns err.
+func skip(dec *packstream.Decoder, n int, err error) error {
+	for ; n > 0; n-- {
+		if skipErr := dec.Skip(); skipErr != nil {
+			return skipErr
+		}
+	}
+	return err
+}
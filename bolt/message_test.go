@@ -0,0 +1,132 @@
+package bolt
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/packstream.v1"
+)
+
+func TestEncode(t *testing.T) {
+	var b bytes.Buffer
+	enc := packstream.NewEncoder(&b)
+
+	tests := []struct {
+		message Message
+		encoded []byte
+	}{
+		{Init{ClientName: "a", AuthToken: map[string]interface{}{}}, []byte{0xB2, 0x01, 0x81, 0x61, 0xA0}},
+		{Init{ClientName: "a"}, []byte{0xB2, 0x01, 0x81, 0x61, 0xA0}},
+		{Hello{Extra: map[string]interface{}{}}, []byte{0xB1, 0x01, 0xA0}},
+		{&Hello{}, []byte{0xB1, 0x01, 0xA0}},
+		{&Run{Statement: "a"}, []byte{0xB2, 0x10, 0x81, 0x61, 0xA0}},
+		{Run{Statement: "a", Parameters: map[string]interface{}{"b": int64(1)}}, []byte{0xB2, 0x10, 0x81, 0x61, 0xA1, 0x81, 0x62, 0x01}},
+		{Run{Statement: "a", Extra: map[string]interface{}{}}, []byte{0xB3, 0x10, 0x81, 0x61, 0xA0, 0xA0}},
+		{Begin{}, []byte{0xB1, 0x11, 0xA0}},
+		{PullAll{}, []byte{0xB0, 0x3F}},
+		{Pull{}, []byte{0xB1, 0x3F, 0xA0}},
+		{Discard{Extra: map[string]interface{}{"n": int64(-1)}}, []byte{0xB1, 0x2F, 0xA1, 0x81, 0x6E, 0xFF}},
+		{Record{Fields: []interface{}{int64(1)}}, []byte{0xB1, 0x71, 0x91, 0x01}},
+		{Record{}, []byte{0xB1, 0x71, 0x90}},
+		{Success{}, []byte{0xB1, 0x70, 0xA0}},
+		{&Success{Metadata: map[string]interface{}{"a": int64(1)}}, []byte{0xB1, 0x70, 0xA1, 0x81, 0x61, 0x01}},
+		{Failure{}, []byte{0xB1, 0x7F, 0xA0}},
+	}
+	for i, test := range tests {
+		b.Reset()
+		if err := Encode(enc, test.message); err != nil {
+			t.Errorf("test %v: unexpected error: %v", i, err)
+		} else if !bytes.Equal(b.Bytes(), test.encoded) {
+			t.Errorf("test %v: got % #X, expected % #X", i, b.Bytes(), test.encoded)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	messages := []Message{
+		&Init{ClientName: "client", AuthToken: map[string]interface{}{"scheme": "none"}},
+		&Hello{Extra: map[string]interface{}{"user_agent": "client"}},
+		&Goodbye{},
+		&AckFailure{},
+		&Reset{},
+		&Run{Statement: "RETURN $a", Parameters: map[string]interface{}{"a": int64(1)}},
+		&Run{Statement: "RETURN 1", Parameters: map[string]interface{}{}, Extra: map[string]interface{}{"db": "a"}},
+		&Begin{Extra: map[string]interface{}{"bookmarks": []interface{}{"b"}}},
+		&Commit{},
+		&Rollback{},
+		&DiscardAll{},
+		&Discard{Extra: map[string]interface{}{"n": int64(-1)}},
+		&PullAll{},
+		&Pull{Extra: map[string]interface{}{"n": int64(10), "qid": int64(1)}},
+		&Success{Metadata: map[string]interface{}{"fields": []interface{}{"a"}}},
+		&Record{Fields: []interface{}{int64(1), "a", nil}},
+		&Ignored{},
+		&Failure{Metadata: map[string]interface{}{"code": "Neo.ClientError", "message": "failure"}},
+	}
+
+	var b bytes.Buffer
+	cw := packstream.NewChunkWriter(&b, 8)
+	enc := packstream.NewEncoder(cw)
+	for _, m := range messages {
+		if err := Encode(enc, m); err != nil {
+			t.Fatal(err)
+		}
+		cw.Close()
+	}
+
+	cr := packstream.NewChunkReader(&b)
+	dec := packstream.NewDecoder(cr)
+	for _, expected := range messages {
+		if err := cr.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := Decode(dec); err != nil {
+			t.Errorf("unexpected error for %T: %v", expected, err)
+		} else if !reflect.DeepEqual(m, expected) {
+			t.Errorf("invalid decoded message, got %#v, expected %#v", m, expected)
+		}
+	}
+}
+
+func TestDecode_Invalid(t *testing.T) {
+	dec := packstream.NewDecoder(bytes.NewReader([]byte{0xB2, 0x3F, 0x01, 0x02, 0xB1, 0x42, 0x91, 0x01, 0xB0, 0x0F}))
+	if _, err := Decode(dec); err != ErrFieldCount {
+		t.Errorf("error should be ErrFieldCount, got %v", err)
+	}
+	if _, err := Decode(dec); err != ErrUnknownMessage {
+		t.Errorf("error should be ErrUnknownMessage, got %v", err)
+	}
+	if m, err := Decode(dec); err != nil {
+		t.Error(err)
+	} else if _, ok := m.(*Reset); !ok {
+		t.Errorf("invalid message after invalid messages, got %#v", m)
+	}
+}
+
+func TestDecode_Limits(t *testing.T) {
+	// The limits of the decoder apply to the whole message, rather than to each field.
+	encoded := []byte{0xB2, 0x10, 0x86, 'R', 'E', 'T', 'U', 'R', 'N', 0xA1, 0x81, 0x61, 0x01}
+	opts := packstream.DecoderOptions{MaxTotalBytes: 10}
+	if _, err := Decode(opts.NewDecoder(bytes.NewReader(encoded))); err != packstream.ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded, got %v", err)
+	}
+	opts.MaxTotalBytes = int64(len(encoded))
+	if _, err := Decode(opts.NewDecoder(bytes.NewReader(encoded))); err != nil {
+		t.Errorf("a message within the limit should be decoded, got %v", err)
+	}
+
+	var te *packstream.UnmarshalTypeError
+	for _, tc := range []struct {
+		encoded []byte
+		path    string
+	}{
+		{[]byte{0xB2, 0x10, 0x81, 'a', 0x91, 0x01}, "Parameters"},
+		{[]byte{0xB1, 0x70, 0xA1, 0x81, 'a', 0x91, 0xA1, 0x01, 0x02}, "Metadata.a[0]"},
+	} {
+		if _, err := Decode(packstream.NewDecoder(bytes.NewReader(tc.encoded))); !errors.As(err, &te) || te.Path != tc.path {
+			t.Errorf("invalid error for % #X, got %v, expected path %q", tc.encoded, err, tc.path)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package packstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math"
+	"sort"
+)
+
+// Canonicalize returns the canonical encoding of the single packstream value encoded by p, so that equal values have
+// the same canonical encoding whichever way they were encoded. In the canonical encoding, integers, strings, byte
+// arrays, lists, maps and structures use their smallest representation, and lists and maps are sized rather than
+// streamed. The entries of maps are sorted in the byte order of their keys, and only the last entry of a duplicated
+// key is kept. The floats which are not a number are encoded as math.NaN().
+//
+// The output of MarshalCanonical is canonical, unless it contains the encoding of a Marshaler or a float which is
+// not a number.
+//
+// Canonicalize returns ErrTrailingData if the value is followed by other bytes, io.EOF if p ends before the value,
+// and ErrUnMarshalTypeError if p is otherwise not valid packstream. As its input is usually untrusted, it returns
+// ErrLimitExceeded if lists, maps and structures are nested more than 10000 levels deep.
+func Canonicalize(p []byte) ([]byte, error) {
+	return DecoderOptions{}.Canonicalize(p)
+}
+
+// maxCanonicalDepth is the maximum nesting depth of the values canonicalized, which are processed recursively.
+const maxCanonicalDepth = 10000
+
+// Canonicalize is like Canonicalize, within the limits of o. The nesting depth is limited to the MaxDepth of o, and
+// in any case to 10000 levels. The alias options of o do not apply.
+func (o DecoderOptions) Canonicalize(p []byte) ([]byte, error) {
+	if o.MaxDepth <= 0 || o.MaxDepth > maxCanonicalDepth {
+		o.MaxDepth = maxCanonicalDepth
+	}
+	d := decodeState{bytes: p, opts: o}
+	c, err := d.canonicalValue(nil)
+	if err != nil {
+		return nil, err
+	} else if d.cursor < uint64(len(p)) {
+		return nil, ErrTrailingData
+	}
+	return c, nil
+}
+
+// IsCanonical reports whether p is the canonical encoding of a single packstream value, as returned by Canonicalize.
+func IsCanonical(p []byte) bool {
+	c, err := Canonicalize(p)
+	return err == nil && bytes.Equal(c, p)
+}
+
+// Hash returns the SHA-256 checksum of the canonical encoding of the packstream value encoded by p, so that equal
+// values have the same hash whichever way they were encoded.
+func Hash(p []byte) (sum [sha256.Size]byte, err error) {
+	var c []byte
+	if c, err = Canonicalize(p); err == nil {
+		sum = sha256.Sum256(c)
+	}
+	return
+}
+
+// canonicalValue reads the next value, and appends its canonical encoding to dst.
+func (d *decodeState) canonicalValue(dst []byte) ([]byte, error) {
+	if err := d.readMarker(); err != nil {
+		return dst, err
+	}
+	return d.canonicalMarker(dst)
+}
+
+// canonicalMarker appends to dst the canonical encoding of the value of the current marker.
+func (d *decodeState) canonicalMarker(dst []byte) ([]byte, error) {
+	switch markerKind(d.marker) {
+	case NullKind:
+		return AppendNull(dst), nil
+	case BoolKind:
+		return AppendBool(dst, d.marker == mTrue), nil
+	case IntKind:
+		n, err := d.readInt()
+		return AppendInt(dst, n), err
+	case FloatKind:
+		f, err := d.readFloat()
+		if math.IsNaN(f) {
+			f = math.NaN()
+		}
+		return AppendFloat(dst, f), err
+	case StringKind:
+		p, err := d.readString()
+		if err != nil {
+			return dst, err
+		}
+		dst, err = appendHeader(dst, len(p), tinyStringSizes, mStringSize8, mStringSize16, mStringSize32)
+		return append(dst, p...), err
+	case BytesKind:
+		p, err := d.readByteArray()
+		if err != nil {
+			return dst, err
+		}
+		return AppendBytes(dst, p)
+	case ListKind, MapKind, StructureKind:
+		if err := d.checkDepth(); err != nil {
+			return dst, err
+		}
+		dst, err := d.canonicalContainer(dst)
+		d.leave()
+		return dst, err
+	}
+	// An end of stream is not a value.
+	return dst, ErrUnMarshalTypeError
+}
+
+// canonicalContainer appends to dst the canonical encoding of the list, map or structure of the current marker.
+func (d *decodeState) canonicalContainer(dst []byte) ([]byte, error) {
+	switch markerKind(d.marker) {
+	case ListKind:
+		return d.canonicalList(dst)
+	case MapKind:
+		return d.canonicalMap(dst)
+	}
+	s, sig, err := d.readStructHeader()
+	if err != nil {
+		return dst, err
+	}
+	if dst, err = AppendStructHeader(dst, int(s), sig); err != nil {
+		return dst, err
+	}
+	for ; s > 0; s-- {
+		if dst, err = d.canonicalValue(dst); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// canonicalList appends to dst the canonical encoding of the list of the current marker.
+func (d *decodeState) canonicalList(dst []byte) ([]byte, error) {
+	s, isStream, err := d.readListSize()
+	if err != nil {
+		return dst, err
+	}
+	if !isStream {
+		if dst, err = AppendListHeader(dst, int(s)); err != nil {
+			return dst, err
+		}
+		for ; s > 0; s-- {
+			if dst, err = d.canonicalValue(dst); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	}
+
+	// The size of a streamed list is only known at its end: its elements are appended first, and then moved after
+	// its header.
+	start, n := len(dst), 0
+	for ; ; n++ {
+		if d.opts.MaxContainerLength > 0 && n > d.opts.MaxContainerLength {
+			return dst, ErrLimitExceeded
+		}
+		if err = d.readMarker(); err != nil {
+			return dst, err
+		} else if d.marker == mEndOfStream {
+			break
+		}
+		if dst, err = d.canonicalMarker(dst); err != nil {
+			return dst, err
+		}
+	}
+	var h [5]byte
+	header, err := AppendListHeader(h[:0], n)
+	if err != nil {
+		return dst, err
+	}
+	end := len(dst)
+	dst = append(dst, header...)
+	copy(dst[start+len(header):], dst[start:end])
+	copy(dst[start:], header)
+	return dst, nil
+}
+
+// canonicalMap appends to dst the canonical encoding of the map of the current marker.
+func (d *decodeState) canonicalMap(dst []byte) ([]byte, error) {
+	s, isStream, err := d.readMapSize()
+	if err != nil {
+		return dst, err
+	}
+
+	// The canonical values are appended to buf, until the entries are sorted.
+	type entry struct {
+		key        string
+		start, end int
+	}
+	var (
+		buf     []byte
+		entries []entry
+	)
+	for i := uint64(0); isStream || i < s; i++ {
+		if d.opts.MaxContainerLength > 0 && i > uint64(d.opts.MaxContainerLength) {
+			return dst, ErrLimitExceeded
+		}
+		if err = d.readMarker(); err != nil {
+			return dst, err
+		} else if isStream && d.marker == mEndOfStream {
+			break
+		} else if markerKind(d.marker) != StringKind {
+			return dst, ErrUnMarshalTypeError
+		}
+		k, err := d.readString()
+		if err != nil {
+			return dst, err
+		}
+		start := len(buf)
+		if buf, err = d.canonicalValue(buf); err != nil {
+			return dst, err
+		}
+		entries = append(entries, entry{string(k), start, len(buf)})
+	}
+
+	// Keep the last entry of each key.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	n := 0
+	for i := range entries {
+		if i+1 < len(entries) && entries[i+1].key == entries[i].key {
+			continue
+		}
+		entries[n] = entries[i]
+		n++
+	}
+
+	if dst, err = AppendMapHeader(dst, n); err != nil {
+		return dst, err
+	}
+	for _, e := range entries[:n] {
+		if dst, err = AppendString(dst, e.key); err != nil {
+			return dst, err
+		}
+		dst = append(dst, buf[e.start:e.end]...)
+	}
+	return dst, nil
+}
@@ -0,0 +1,129 @@
+package packstream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	for _, tc := range []struct {
+		p, res []byte
+	}{
+		{[]byte{mInt64, 0, 0, 0, 0, 0, 0, 0, 0x2A}, []byte{0x2A}},
+		{[]byte{mInt16, 0xFF, 0x80}, []byte{mInt8, 0x80}},
+		{[]byte{mStringSize8, 0x03, 'a', 'b', 'c'}, []byte{0x83, 'a', 'b', 'c'}},
+		{[]byte{mBytesSize16, 0x00, 0x01, 0x01}, []byte{mBytesSize8, 0x01, 0x01}},
+		{[]byte{mListSize8, 0x02, mInt8, 0x01, mNull}, []byte{0x92, 0x01, mNull}},
+		{[]byte{mListSizeStream, mListSizeStream, mEndOfStream, 0x01, mEndOfStream}, []byte{0x92, 0x90, 0x01}},
+		{[]byte{mStructSize8, 0x01, 0x4E, mInt32, 0, 0, 0, 0x01}, []byte{0xB1, 0x4E, 0x01}},
+		{
+			// Sorted keys, the last entry of a duplicated key being kept.
+			[]byte{mMapSizeStream, 0x81, 'b', 0x01, 0x81, 'a', 0x02, 0x81, 'b', mMapSize8, 0x01, 0x81, 'c', 0x03,
+				mEndOfStream},
+			[]byte{0xA2, 0x81, 'a', 0x02, 0x81, 'b', 0xA1, 0x81, 'c', 0x03},
+		},
+		{
+			AppendFloat(nil, math.Float64frombits(0x7FF8000000000000)),
+			AppendFloat(nil, math.NaN()),
+		},
+	} {
+		if c, err := Canonicalize(tc.p); err != nil {
+			t.Errorf("error while canonicalizing % #X: %v", tc.p, err)
+		} else if !bytes.Equal(c, tc.res) {
+			t.Errorf("invalid canonical encoding of % #X, got % #X, expected % #X", tc.p, c, tc.res)
+		} else if !IsCanonical(c) {
+			t.Errorf("% #X should be canonical", c)
+		} else if IsCanonical(tc.p) {
+			t.Errorf("% #X should not be canonical", tc.p)
+		}
+	}
+}
+
+func TestCanonicalize_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		p   []byte
+		err error
+	}{
+		{[]byte{0x01, 0x02}, ErrTrailingData},
+		{[]byte{0x92, 0x01}, io.EOF},
+		{[]byte{0xA1, 0x01, 0x01}, ErrUnMarshalTypeError},
+		{[]byte{0x91, mEndOfStream}, ErrUnMarshalTypeError},
+		{[]byte{0xC4}, ErrUnMarshalTypeError},
+		{nil, io.EOF},
+	} {
+		if _, err := Canonicalize(tc.p); !errors.Is(err, tc.err) {
+			t.Errorf("canonicalizing % #X should fail with %v, got %v", tc.p, tc.err, err)
+		} else if IsCanonical(tc.p) {
+			t.Errorf("% #X should not be canonical", tc.p)
+		}
+	}
+}
+
+func TestCanonicalize_Limits(t *testing.T) {
+	deep := append(bytes.Repeat([]byte{0x91}, 5<<20), 0x01)
+	if _, err := Canonicalize(deep); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for deeply nested lists, got %v", err)
+	}
+	if _, err := Canonicalize(deep[len(deep)-maxCanonicalDepth-1:]); err != nil {
+		t.Errorf("lists nested within the limit should be canonicalized, got %v", err)
+	}
+
+	opts := DecoderOptions{MaxDepth: 2, MaxContainerLength: 2}
+	for _, p := range [][]byte{
+		{0x91, 0x91, 0x91, 0x01},
+		{0x93, 0x01, 0x02, 0x03},
+		{mListSizeStream, 0x01, 0x02, 0x03, mEndOfStream},
+		{mMapSizeStream, 0x81, 'a', 0x01, 0x81, 'b', 0x02, 0x81, 'c', 0x03, mEndOfStream},
+	} {
+		if _, err := opts.Canonicalize(p); err != ErrLimitExceeded {
+			t.Errorf("error should be ErrLimitExceeded for % #X, got %v", p, err)
+		}
+	}
+	if c, err := opts.Canonicalize([]byte{mListSizeStream, 0x91, 0x01, 0x02, mEndOfStream}); err != nil {
+		t.Error(err)
+	} else if res := []byte{0x92, 0x91, 0x01, 0x02}; !bytes.Equal(c, res) {
+		t.Errorf("invalid canonical encoding, got % #X, expected % #X", c, res)
+	}
+}
+
+func TestMarshalCanonical_IsCanonical(t *testing.T) {
+	p, err := MarshalCanonical(map[string]interface{}{
+		"list":  []interface{}{int64(1000), "a", []byte{1}, nil, true},
+		"map":   map[string]int{"z": 1, "y": 2, "x": 3},
+		"nodes": []Node{{ID: 1, Labels: []string{"A"}, Properties: map[string]interface{}{"b": 0.5, "a": 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsCanonical(p) {
+		t.Errorf("the output of MarshalCanonical should be canonical, got % #X", p)
+	}
+}
+
+func TestHash(t *testing.T) {
+	h1, err := Hash([]byte{mMapSizeStream, 0x81, 'b', mInt64, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x81, 'a', 0x02, mEndOfStream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := MarshalCanonical(map[string]int{"a": 2, "b": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2, err := Hash(p); err != nil {
+		t.Error(err)
+	} else if h1 != h2 {
+		t.Errorf("equal values should have the same hash, got %X and %X", h1, h2)
+	}
+
+	if h3, err := Hash([]byte{0x01}); err != nil {
+		t.Error(err)
+	} else if h3 == h1 {
+		t.Error("different values should have different hashes")
+	}
+	if _, err := Hash([]byte{0x92}); err != io.EOF {
+		t.Errorf("hashing an invalid value should fail, got %v", err)
+	}
+}
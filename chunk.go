@@ -0,0 +1,150 @@
+package packstream
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// MaxChunkSize is the maximum number of bytes of a Bolt chunk.
+const MaxChunkSize = math.MaxUint16
+
+// ChunkWriter writes messages in the Bolt chunked framing: each chunk is made of its size, as a 2 bytes big endian
+// integer, followed by its bytes, and each message is terminated by an empty chunk.
+//
+// The bytes of a message are buffered and written as full chunks, until the message is ended by Close. The same
+// ChunkWriter can then be used to write the next message.
+type ChunkWriter struct {
+	wr   io.Writer
+	buf  []byte
+	size int
+}
+
+// NewChunkWriter returns a new ChunkWriter that writes to wr chunks of at most size bytes.
+// If size is not between 1 and MaxChunkSize, MaxChunkSize is used.
+func NewChunkWriter(wr io.Writer, size int) *ChunkWriter {
+	if size <= 0 || size > MaxChunkSize {
+		size = MaxChunkSize
+	}
+	return &ChunkWriter{wr: wr, buf: make([]byte, 2, 2+size), size: size}
+}
+
+// Write writes p to the current message, writing the chunks which are full.
+func (c *ChunkWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+m]
+		n += m
+		p = p[m:]
+		if len(c.buf) == cap(c.buf) {
+			if err = c.flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Close ends the current message: it writes the pending chunk, followed by the end of message marker.
+// It does not close the underlying writer.
+func (c *ChunkWriter) Close() (err error) {
+	if len(c.buf) > 2 {
+		if err = c.flush(); err != nil {
+			return
+		}
+	}
+	_, err = c.wr.Write([]byte{0x00, 0x00})
+	return
+}
+
+// flush writes the buffered bytes as a chunk.
+func (c *ChunkWriter) flush() (err error) {
+	binary.BigEndian.PutUint16(c.buf, uint16(len(c.buf)-2))
+	_, err = c.wr.Write(c.buf)
+	c.buf = c.buf[:2]
+	return
+}
+
+// ChunkReader reads messages in the Bolt chunked framing, one message at a time.
+//
+// Next must be called to move to each message, whose bytes are then read by Read, without the chunk headers.
+type ChunkReader struct {
+	rd        io.Reader
+	header    [2]byte
+	remaining int
+	end       bool
+}
+
+// NewChunkReader returns a new ChunkReader that reads from rd.
+func NewChunkReader(rd io.Reader) *ChunkReader {
+	return &ChunkReader{rd: rd, end: true}
+}
+
+// Next discards the remaining bytes of the current message, and moves to the next message. Empty messages, which
+// are used as keep-alive by Bolt, are skipped.
+// It returns io.EOF if the input ends before a new message.
+func (c *ChunkReader) Next() (err error) {
+	for !c.end {
+		if c.remaining, err = c.readChunk(); err != nil {
+			return
+		}
+	}
+	for c.remaining == 0 {
+		if _, err = io.ReadFull(c.rd, c.header[:]); err != nil {
+			return
+		}
+		c.remaining = int(binary.BigEndian.Uint16(c.header[:]))
+	}
+	c.end = false
+	return
+}
+
+// Read reads the bytes of the current message. It returns io.EOF at the end of the message.
+// If the input ends within a message, it returns io.ErrUnexpectedEOF.
+func (c *ChunkReader) Read(p []byte) (n int, err error) {
+	if c.end {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		if c.remaining, err = c.readChunk(); err != nil {
+			return
+		} else if c.remaining == 0 {
+			return 0, io.EOF
+		}
+	}
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err = c.rd.Read(p)
+	c.remaining -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// readChunk reads the bytes remaining in the current chunk and the header of the next one, and returns its size.
+// A zero size ends the current message.
+func (c *ChunkReader) readChunk() (s int, err error) {
+	if c.remaining > 0 {
+		if _, err = io.CopyN(io.Discard, c.rd, int64(c.remaining)); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		c.remaining = 0
+	}
+	if _, err = io.ReadFull(c.rd, c.header[:]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if s = int(binary.BigEndian.Uint16(c.header[:])); s == 0 {
+		c.end = true
+	}
+	return
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package packstream
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChunkWriter(t *testing.T) {
+	var b bytes.Buffer
+	cw := NewChunkWriter(&b, 3)
+	cw.Write([]byte{1, 2})
+	cw.Write([]byte{3, 4, 5, 6, 7})
+	if err := cw.Close(); err != nil {
+		t.Error(err)
+	}
+	cw.Write([]byte{8})
+	if err := cw.Close(); err != nil {
+		t.Error(err)
+	}
+
+	res := []byte{0x00, 0x03, 1, 2, 3, 0x00, 0x03, 4, 5, 6, 0x00, 0x01, 7, 0x00, 0x00, 0x00, 0x01, 8, 0x00, 0x00}
+	if !bytes.Equal(b.Bytes(), res) {
+		t.Errorf("invalid chunks, got % #X, expected % #X", b.Bytes(), res)
+	}
+
+	b.Reset()
+	cw = NewChunkWriter(&b, 0)
+	cw.Write(make([]byte, MaxChunkSize+1))
+	cw.Close()
+	if b.Len() != MaxChunkSize+7 || !bytes.Equal(b.Bytes()[:2], []byte{0xFF, 0xFF}) {
+		t.Errorf("invalid chunks of default size, got %v bytes", b.Len())
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	var (
+		b    bytes.Buffer
+		s    string
+		i    int64
+		long = strings.Repeat("packstream", 1000)
+	)
+	cw := NewChunkWriter(&b, 16)
+	enc := NewEncoder(cw)
+	enc.Encode(long)
+	cw.Close()
+	cw.Close()
+	enc.Encode([]interface{}{"skipped", 1})
+	cw.Close()
+	enc.Encode(42)
+	cw.Close()
+
+	cr := NewChunkReader(&b)
+	dec := NewDecoder(cr)
+	if err := cr.Next(); err != nil {
+		t.Error(err)
+	} else if err := dec.Decode(&s); err != nil {
+		t.Error(err)
+	} else if s != long {
+		t.Errorf("invalid decoded message, got %v bytes", len(s))
+	} else if n, err := cr.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("reading after the end of a message should return io.EOF, got %v, %v", n, err)
+	}
+
+	// The empty message is skipped, and the unread message discarded.
+	if err := cr.Next(); err != nil {
+		t.Error(err)
+	} else if err := cr.Next(); err != nil {
+		t.Error(err)
+	} else if err := dec.Decode(&i); err != nil {
+		t.Error(err)
+	} else if i != 42 {
+		t.Errorf("invalid decoded message, got %v", i)
+	}
+
+	if err := cr.Next(); err != io.EOF {
+		t.Errorf("error should be io.EOF at the end of the input, got %v", err)
+	}
+}
+
+func TestChunkReader_Truncated(t *testing.T) {
+	cr := NewChunkReader(bytes.NewReader([]byte{0x00, 0x03, 1, 2, 3, 0x00, 0x04, 4}))
+	if err := cr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := io.ReadAll(cr); err != io.ErrUnexpectedEOF {
+		t.Errorf("error should be io.ErrUnexpectedEOF, got %v", err)
+	} else if !bytes.Equal(p, []byte{1, 2, 3, 4}) {
+		t.Errorf("invalid message bytes, got % #X", p)
+	}
+
+	cr = NewChunkReader(bytes.NewReader([]byte{0x00, 0x01, 1}))
+	cr.Next()
+	if err := cr.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("error should be io.ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -2,58 +2,66 @@ package packstream
 
 import (
 	"bytes"
-	"encoding/binary"
+	"encoding"
+	"errors"
 	"io"
-	"math"
 	"reflect"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
+	"unsafe"
 )
 
 // Decoder can read and decodes packstream data from an input stream.
 type Decoder struct {
-	stream io.Reader
+	*decodeState
 }
 
 // NewDecoder returns a new decoder that reads from rd.
 func NewDecoder(rd io.Reader) *Decoder {
-	return &Decoder{stream: rd}
+	return &Decoder{&decodeState{stream: rd}}
 }
 
 type decodeState struct {
-	stream io.Reader
-	bytes  []byte
-	cursor uint64
-	marker byte
-	eos    bool
+	stream  io.Reader
+	bytes   []byte
+	cursor  uint64
+	marker  byte
+	peeked  bool
+	eos     bool
+	scratch [8]byte
+	discard []byte
+	path    []pathElem
+	depth   int
+	base    uint64
+	nested  int
+
+	timeFormat TimeFormat
+	opts       DecoderOptions
 }
 
 // readBytes reads s bytes from the input, and returns, and move d.cursor.
 // If there is not enough bytes to read, readBytes returns io.EOF error.
 func (d *decodeState) readBytes(s uint64) ([]byte, error) {
-	var (
-		p1 [1]byte
-		p2 [2]byte
-		p4 [4]byte
-		p8 [8]byte
-		p  []byte
-	)
-
+	if err := d.checkRead(s); err != nil {
+		return nil, err
+	}
 	if d.stream != nil {
-		switch s {
-		default:
-			p = make([]byte, s)
-		case 1:
-			p = p1[:]
-		case 2:
-			p = p2[:]
-		case 4:
-			p = p4[:]
-		case 8:
-			p = p8[:]
-		}
-
-		if _, err := io.ReadFull(d.stream, p); err != nil {
+		if s > maxPrealloc {
+			// Do not trust the size: grow as the bytes are read.
+			var b bytes.Buffer
+			n, err := io.CopyN(&b, d.stream, int64(s))
+			d.cursor += uint64(n)
+			if err != nil {
+				return nil, err
+			}
+			return b.Bytes(), nil
+		}
+		p := make([]byte, s)
+		n, err := io.ReadFull(d.stream, p)
+		d.cursor += uint64(n)
+		if err != nil {
 			if err == io.ErrUnexpectedEOF {
 				return nil, io.EOF
 			}
@@ -71,13 +79,84 @@ func (d *decodeState) readBytes(s uint64) ([]byte, error) {
 	return d.bytes[i : i+s], nil
 }
 
-// readMarker reads one byte and set d.marker
+// readFixed reads s bytes from the input, s being at most 8. Unlike readBytes, it does not allocate:
+// the returned slice is only valid until the next read.
+func (d *decodeState) readFixed(s uint64) ([]byte, error) {
+	if d.stream == nil {
+		return d.readBytes(s)
+	}
+	if err := d.checkRead(s); err != nil {
+		return nil, err
+	}
+	p := d.scratch[:s]
+	n, err := io.ReadFull(d.stream, p)
+	d.cursor += uint64(n)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// skipBytes advances over s bytes of the input, without allocating them.
+func (d *decodeState) skipBytes(s uint64) error {
+	if d.stream == nil {
+		_, err := d.readBytes(s)
+		return err
+	}
+	if err := d.checkRead(s); err != nil {
+		return err
+	}
+	if d.discard == nil {
+		d.discard = make([]byte, 4096)
+	}
+	for s > 0 {
+		n := uint64(len(d.discard))
+		if s < n {
+			n = s
+		}
+		m, err := io.ReadFull(d.stream, d.discard[:n])
+		d.cursor += uint64(m)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return io.EOF
+			}
+			return err
+		}
+		s -= n
+	}
+	return nil
+}
+
+// offsetReader reads from the input stream of a decodeState, counting the bytes read in its cursor.
+type offsetReader struct {
+	d *decodeState
+}
+
+func (r offsetReader) Read(p []byte) (n int, err error) {
+	if rem := r.d.remaining(); rem == 0 {
+		return 0, ErrLimitExceeded
+	} else if rem > 0 && int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	n, err = r.d.stream.Read(p)
+	r.d.cursor += uint64(n)
+	return
+}
+
+// readMarker reads one byte and set d.marker, unless a marker has already been peeked.
 func (d *decodeState) readMarker() error {
 	var (
 		p   []byte
 		err error
 	)
-	if p, err = d.readBytes(1); err != nil {
+	if d.peeked {
+		d.peeked = false
+		return nil
+	}
+	if p, err = d.readFixed(1); err != nil {
 		return err
 	}
 	d.marker = p[0]
@@ -87,7 +166,7 @@ func (d *decodeState) readMarker() error {
 // readSize reads 1, 2 or 4 bytes and interpret them as an uint64.
 func (d *decodeState) readSize(s uint64) (ui uint64, err error) {
 	var p []byte
-	if p, err = d.readBytes(s); err != nil {
+	if p, err = d.readFixed(s); err != nil {
 		return
 	}
 	switch s {
@@ -108,8 +187,42 @@ func (d *decodeState) readSize(s uint64) (ui uint64, err error) {
 // Decode reads the next packstream encoded value from its input and stores it in the value pointed to by v.
 // See the documentation for Unmarshal for details about the conversion of packstream into a Go value.
 func (d *Decoder) Decode(v interface{}) error {
-	dec := &decodeState{stream: d.stream}
-	return dec.unmarshal(v)
+	d.begin()
+	return d.unmarshal(v)
+}
+
+// SetTimeFormat sets the representation of the integers decoded by d into time.Time values, which may either be
+// TimeUnixNano, the default, or TimeUnixMilli. Strings and structures are decoded whatever the format.
+func (d *Decoder) SetTimeFormat(f TimeFormat) {
+	d.timeFormat = f
+}
+
+// More reports whether there is another value to decode: it returns false at the end of the input, or when the next
+// marker ends a streamed list or map. It also returns false if reading the input fails.
+func (d *Decoder) More() bool {
+	if err := d.peekMarker(); err != nil {
+		return false
+	}
+	return d.marker != mEndOfStream
+}
+
+// InputOffset returns the number of bytes of the input which have been consumed by d. It is the offset of the
+// next value, once the previous one has been decoded.
+func (d *Decoder) InputOffset() int64 {
+	if d.peeked {
+		return int64(d.cursor) - 1
+	}
+	return int64(d.cursor)
+}
+
+// Buffered returns a reader of the data which has been read from the input by d, but not consumed yet. A Decoder
+// reads its input without buffering, except for the marker of the next value, which is peeked by More or PeekKind.
+// The rest of the input can then be read from io.MultiReader(d.Buffered(), rd).
+func (d *Decoder) Buffered() io.Reader {
+	if d.peeked {
+		return bytes.NewReader([]byte{d.marker})
+	}
+	return bytes.NewReader(nil)
 }
 
 /*
@@ -128,32 +241,61 @@ Unmarshal can decode the following go values:
 	uint, uint8, uint16, uint32, uint64
 	string
 	[]byte
-	[]interface{}
-	map[string]interface{}
+	slices and arrays
+	maps
 	Structure
 	time.Time
+	structs
+
+To unmarshal a packstream structure into a Go struct implementing the Signer interface, or whose type has been
+registered with RegisterStructure, Unmarshal checks the structure signature and decodes the structure fields into the
+exported struct fields, in declaration order. Additional structure fields are discarded, and additional struct fields
+are set to zero values. When decoding into an empty interface, structures whose signature has been registered are
+stored as values of the registered type rather than as Structure.
+
+To unmarshal a packstream map into a struct, Unmarshal matches incoming map keys to the keys used by Marshal (either
+the struct field name or its tag), preferring an exact match but also accepting a case-insensitive match.
+Map entries which do not match any struct field are ignored.
 
 To unmarshal a list into a Go array, Unmarshal decodes packstream list elements into corresponding Go array elements.
 If the Go array is smaller than the JSON array, the additional JSON array elements are discarded.
 If the JSON array is smaller than the Go array, the additional Go array elements are set to zero values.
 
-To unmarshal a packstream map into a string-keyed map, Unmarshal first establishes a map to use.
+To unmarshal a packstream map into a Go map, Unmarshal first establishes a map to use.
 If the map is nil, Unmarshal allocates a new map.
 Otherwise Unmarshal reuses the existing map, keeping existing entries.
-Unmarshal then stores key-value pairs from the packstream map into the map.
+Unmarshal then stores key-value pairs from the packstream map into the map, decoding each value into the element type
+of the map. The keys of the Go map must either be strings, integers, which are parsed from decimal, or implement
+encoding.TextUnmarshaler, as in encoding/json. Likewise, the elements of a list are decoded into the element type of
+a Go slice or array.
 
-To unmarshal a time.Time, the packstream value must be an integer, which represents the number of nanoseconds elapsed
-since January 1, 1970 UTC. Then, the time structure is filled using time.Unix(). If the integer is zero, it unmarshals
-a zero value time.Time.
+To unmarshal a time.Time, the packstream value must either be an integer, an ISO 8601 string in the RFC 3339 format,
+or a Neo4j DateTime structure. An integer represents the number of nanoseconds elapsed since January 1, 1970 UTC,
+unless another format is set with the SetTimeFormat method of a Decoder, and unmarshals as a UTC time. If the integer
+is zero, it unmarshals a zero value time.Time. Strings and structures keep their time zone offset.
 
 If a packstream value is not appropriate for a given target type, or if a number overflows the target type,
-Unmarshal returns an error.
+Unmarshal returns an UnmarshalTypeError, giving the offset of the value in the input and its path from v.
+
+Strings and byte arrays are copied from data, which can be reused once Unmarshal returns. UnmarshalNoCopy avoids the
+copy of byte arrays.
+
+Unmarshal does not limit the depth nor the size of the decoded values. Untrusted input should rather be decoded with
+the Unmarshal or NewDecoder methods of DecoderOptions.
 */
 func Unmarshal(data []byte, v interface{}) error {
 	dec := decodeState{bytes: data}
 	return dec.unmarshal(v)
 }
 
+// UnmarshalNoCopy is like Unmarshal, except that the byte arrays decoded into []byte or empty interface values alias
+// data instead of being copied. data must then not be modified while the decoded values are in use.
+//
+// Strings can also alias data, with the AliasStrings field of DecoderOptions.
+func UnmarshalNoCopy(data []byte, v interface{}) error {
+	return DecoderOptions{AliasBytes: true}.Unmarshal(data, v)
+}
+
 func (d *decodeState) unmarshal(v interface{}) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -173,9 +315,9 @@ func (d *decodeState) unmarshal(v interface{}) (err error) {
 
 // indirect walks down v allocating pointers as needed,
 // until it gets to a non-pointer.
-// if it encounters an Unmarshaler, indirect stops and returns that.
+// if it encounters an Unmarshaler or a StreamUnmarshaler, indirect stops and returns that.
 // if decodingNull is true, indirect stops at the last pointer so it can be set to nil.
-func indirect(v reflect.Value, decodingNull bool) (Unmarshaler, reflect.Value) {
+func indirect(v reflect.Value, decodingNull bool) (Unmarshaler, StreamUnmarshaler, reflect.Value) {
 	// If v is a named type and is addressable,
 	// start with its address, so that if the type has pointer methods,
 	// we find them.
@@ -204,29 +346,103 @@ func indirect(v reflect.Value, decodingNull bool) (Unmarshaler, reflect.Value) {
 			v.Set(reflect.New(v.Type().Elem()))
 		}
 		if v.Type().NumMethod() > 0 {
+			if su, ok := v.Interface().(StreamUnmarshaler); ok {
+				return nil, su, reflect.Value{}
+			}
 			if u, ok := v.Interface().(Unmarshaler); ok {
-				return u, reflect.Value{}
+				return u, nil, reflect.Value{}
 			}
 		}
 		v = v.Elem()
 	}
-	return nil, v
+	return nil, nil, v
 }
 
 func (d *decodeState) value(rv reflect.Value) (err error) {
 	if err = d.readMarker(); err != nil {
 		return
 	}
+	m, offset := d.marker, d.cursor-1
+	if m == mEndOfStream {
+		// The end of a streamed list or map, whatever the type of its elements.
+		d.eos = true
+		return
+	}
+	k := markerKind(m)
+	container := k == ListKind || k == MapKind || k == StructureKind
+	if container {
+		if err = d.checkDepth(); err != nil {
+			return
+		}
+	}
+	if err = typeDecoder(rv.Type())(d, rv); err == ErrUnMarshalTypeError {
+		err = d.typeError(m, rv, offset)
+	}
+	if container {
+		d.leave()
+	}
+	return
+}
 
+// markerValue decodes the value of the current marker into rv.
+func (d *decodeState) markerValue(rv reflect.Value) (err error) {
 	if d.marker == mNull {
 		return d.unmarshalNull(rv)
 	}
 
-	unmarshaler, rev := indirect(rv, false)
-	if unmarshaler != nil {
+	unmarshaler, streamUnmarshaler, rev := indirect(rv, false)
+	if streamUnmarshaler != nil {
+		return d.unmarshalStreamUnmarshaler(streamUnmarshaler)
+	} else if unmarshaler != nil {
 		return d.unmarshalUnmarshaler(unmarshaler)
 	}
+	return d.directValue(rev)
+}
+
+// decoderFunc decodes the value of the current marker into a value of a given Go type.
+type decoderFunc func(d *decodeState, rv reflect.Value) error
+
+var (
+	unmarshalerType       = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	streamUnmarshalerType = reflect.TypeOf((*StreamUnmarshaler)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+	// decoderCache holds the decoderFunc of the Go types, as a map[reflect.Type]decoderFunc.
+	decoderCache sync.Map
+)
+
+// typeDecoder returns the decoderFunc of the Go type t.
+func typeDecoder(t reflect.Type) decoderFunc {
+	if f, ok := decoderCache.Load(t); ok {
+		return f.(decoderFunc)
+	}
+	f, _ := decoderCache.LoadOrStore(t, newTypeDecoder(t))
+	return f.(decoderFunc)
+}
+
+// newTypeDecoder builds the decoderFunc of the Go type t. Only the values which are pointers, interfaces or
+// Unmarshalers need to be walked by indirect; the others are decoded directly.
+func newTypeDecoder(t reflect.Type) decoderFunc {
+	if t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface || t.Implements(unmarshalerType) ||
+		reflect.PtrTo(t).Implements(unmarshalerType) || t.Implements(streamUnmarshalerType) ||
+		reflect.PtrTo(t).Implements(streamUnmarshalerType) {
+		return (*decodeState).markerValue
+	}
+	return func(d *decodeState, rv reflect.Value) error {
+		if d.marker == mNull {
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
+		return d.directValue(rv)
+	}
+}
 
+// directValue decodes the value of the current marker, which is not null, into rv, which is neither a pointer nor
+// an Unmarshaler.
+func (d *decodeState) directValue(rev reflect.Value) (err error) {
+	if rev.Type() == timeType {
+		return d.unmarshalTime(rev)
+	}
 	if d.marker >= mTinyStringStart && d.marker <= mTinyStructEnd {
 		return d.unmarshalTiny(rev)
 	}
@@ -250,8 +466,6 @@ func (d *decodeState) value(rv reflect.Value) (err error) {
 		err = d.unmarshalFloat(rev)
 	case mFalse, mTrue:
 		err = d.unmarshalBool(rev)
-	case mEndOfStream:
-		d.eos = true
 	}
 	return
 }
@@ -272,85 +486,69 @@ func (d *decodeState) unmarshalTiny(rv reflect.Value) (err error) {
 }
 
 func (d *decodeState) unmarshalNull(rv reflect.Value) error {
-	unmarshaler, rev := indirect(rv, true)
-	if unmarshaler != nil {
+	unmarshaler, streamUnmarshaler, rev := indirect(rv, true)
+	if streamUnmarshaler != nil {
+		return d.unmarshalStreamUnmarshaler(streamUnmarshaler)
+	} else if unmarshaler != nil {
 		return d.unmarshalUnmarshaler(unmarshaler)
 	}
 	rev.Set(reflect.Zero(rev.Type()))
 	return nil
 }
 
+// unmarshalStreamUnmarshaler hands the value of the current marker to a StreamUnmarshaler, through a Decoder which
+// shares the state of d.
+func (d *decodeState) unmarshalStreamUnmarshaler(su StreamUnmarshaler) error {
+	// A container has already been entered by d.value: leave it, as su may decode it again with Decode.
+	k := markerKind(d.marker)
+	container := k == ListKind || k == MapKind || k == StructureKind
+	if container {
+		d.leave()
+	}
+	d.peeked = true
+	d.nested++
+	err := su.DecodePS(&Decoder{d})
+	d.nested--
+	if container {
+		d.depth++
+	}
+	return err
+}
+
 func (d *decodeState) unmarshalUnmarshaler(um Unmarshaler) error {
 	var rd *bytes.Reader
 
+	if raw, ok := um.(*RawMessage); ok {
+		return d.unmarshalRaw(raw)
+	}
+
 	if d.stream != nil {
-		return um.UnmarshalPS(d.marker, d.stream)
+		return um.UnmarshalPS(d.marker, offsetReader{d})
 	}
 
 	rd = bytes.NewReader(d.bytes[d.cursor:])
 	i := rd.Len()
-	err := um.UnmarshalPS(d.marker, rd)
+	var r io.Reader = rd
+	if rem := d.remaining(); rem >= 0 && rem < int64(i) {
+		r = &limitedReader{rd, rem}
+	}
+	err := um.UnmarshalPS(d.marker, r)
 	d.cursor += uint64(i - rd.Len())
 	return err
 }
 
 func (d *decodeState) unmarshalInt(rv reflect.Value) (err error) {
 	var (
-		p []byte
 		v int64
 		u uint64
 	)
 
-	switch {
-	case minTinyInt <= int8(d.marker):
-		v = int64(int8(d.marker))
-	case d.marker == mInt8:
-		if p, err = d.readBytes(1); err != nil {
-			return err
-		}
-		v = int64(int8(p[0]))
-	case d.marker == mInt16:
-		if p, err = d.readBytes(2); err != nil {
-			return err
-		}
-		i := int16(0)
-		i |= int16(p[0]) << 8
-		i |= int16(p[1])
-		v = int64(i)
-	case d.marker == mInt32:
-		if p, err = d.readBytes(4); err != nil {
-			return err
-		}
-		i := int32(0)
-		i |= int32(p[0]) << 24
-		i |= int32(p[1]) << 16
-		i |= int32(p[2]) << 8
-		i |= int32(p[3])
-		v = int64(i)
-	case d.marker == mInt64:
-		if p, err = d.readBytes(8); err != nil {
-			return err
-		}
-		v |= int64(p[0]) << 56
-		v |= int64(p[1]) << 48
-		v |= int64(p[2]) << 40
-		v |= int64(p[3]) << 32
-		v |= int64(p[4]) << 24
-		v |= int64(p[5]) << 16
-		v |= int64(p[6]) << 8
-		v |= int64(p[7])
+	if v, err = d.readInt(); err != nil {
+		return
 	}
 	switch rv.Kind() {
 	default:
-		if rv.Type().PkgPath() == "time" && rv.Type().Name() == "Time" {
-			if v != 0 {
-				rv.Set(reflect.ValueOf(time.Unix(0, v).UTC()))
-			} else {
-				rv.Set(reflect.ValueOf(time.Time{}))
-			}
-		} else {
-			err = ErrUnMarshalTypeError
-		}
+		err = ErrUnMarshalTypeError
 	case reflect.Interface:
 		if rv.NumMethod() != 0 {
 			err = ErrUnMarshalTypeError
@@ -378,28 +576,46 @@ func (d *decodeState) unmarshalInt(rv reflect.Value) (err error) {
 	return
 }
 
-func (d *decodeState) unmarshalString(rv reflect.Value) (err error) {
+func (d *decodeState) unmarshalTime(rv reflect.Value) (err error) {
 	var (
-		p []byte
-		s uint64
+		tm time.Time
+		v  int64
+		p  []byte
+		dt DateTime
 	)
-	if (d.marker & 0xF0) == mTinyStringStart {
-		s = uint64(d.marker & 0x0F)
-	} else {
-		switch {
-		case d.marker == mStringSize8:
-			s, err = d.readSize(1)
-		case d.marker == mStringSize16:
-			s, err = d.readSize(2)
-		case d.marker == mStringSize32:
-			s, err = d.readSize(4)
+
+	switch markerKind(d.marker) {
+	default:
+		return ErrUnMarshalTypeError
+	case IntKind:
+		if v, err = d.readInt(); err != nil {
+			return
 		}
-		if err != nil {
+		if v != 0 && d.timeFormat == TimeUnixMilli {
+			tm = time.UnixMilli(v).UTC()
+		} else if v != 0 {
+			tm = time.Unix(0, v).UTC()
+		}
+	case StringKind:
+		if p, err = d.readString(); err != nil {
 			return
 		}
+		if tm, err = time.Parse(time.RFC3339Nano, string(p)); err != nil {
+			return ErrUnMarshalTypeError
+		}
+	case StructureKind:
+		if err = d.unmarshalUnmarshaler(&dt); err != nil {
+			return
+		}
+		tm = dt.Time
 	}
+	rv.Set(reflect.ValueOf(tm))
+	return
+}
 
-	if p, err = d.readBytes(s); err != nil {
+func (d *decodeState) unmarshalString(rv reflect.Value) (err error) {
+	var p []byte
+	if p, err = d.readString(); err != nil {
 		return
 	}
 	switch rv.Kind() {
@@ -409,11 +625,10 @@ func (d *decodeState) unmarshalString(rv reflect.Value) (err error) {
 		if rv.NumMethod() != 0 {
 			err = ErrUnMarshalTypeError
 		} else {
-			rv.Set(reflect.ValueOf(string(p)))
+			rv.Set(reflect.ValueOf(d.toString(p)))
 		}
 	case reflect.String:
-		rv.Set(reflect.ValueOf(string(p)))
-
+		rv.SetString(d.toString(p))
 	}
 	return
 }
@@ -422,37 +637,25 @@ func (d *decodeState) unmarshalList(rv reflect.Value) (err error) {
 	var (
 		s        uint64
 		isStream bool
+		iface    reflect.Value
 	)
 
 	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array && rv.Kind() != reflect.Interface {
 		return ErrUnMarshalTypeError
 	}
 
-	if (d.marker & 0xF0) == mTinyListStart {
-		s = uint64(d.marker & 0x0F)
-	} else {
-		switch {
-		case d.marker == mListSize8:
-			s, err = d.readSize(1)
-		case d.marker == mListSize16:
-			s, err = d.readSize(2)
-		case d.marker == mListSize32:
-			s, err = d.readSize(4)
-		case d.marker == mListSizeStream:
-			isStream = true
-		}
-		if err != nil {
-			return
-		}
+	if s, isStream, err = d.readListSize(); err != nil {
+		return
 	}
 
 	if rv.Kind() == reflect.Interface {
 		if rv.NumMethod() != 0 {
 			return ErrUnMarshalTypeError
 		}
-		l := make([]interface{}, s)
-		rv.Set(reflect.ValueOf(l))
-		rv = rv.Elem()
+		// Decode into an addressable slice, so that a streamed list can grow it.
+		l := make([]interface{}, d.preallocLen(s))
+		iface = rv
+		rv = reflect.ValueOf(&l).Elem()
 	}
 
 	if !isStream {
@@ -461,36 +664,33 @@ func (d *decodeState) unmarshalList(rv reflect.Value) (err error) {
 		err = d.unmarshalStreamedList(rv)
 	}
 
+	if iface.IsValid() {
+		iface.Set(rv)
+	}
 	return
 }
 
 func (d *decodeState) unmarshalStreamedList(rv reflect.Value) (err error) {
-	var skipper interface{}
 	i := 0
 	for {
-		if i >= rv.Cap() {
-			newcap := rv.Cap() + rv.Cap()/2
-			if newcap < 4 {
-				newcap = 4
-			}
-			newv := reflect.MakeSlice(rv.Type(), rv.Len(), newcap)
-			reflect.Copy(newv, rv)
-			rv.Set(newv)
+		if d.opts.MaxContainerLength > 0 && i > d.opts.MaxContainerLength {
+			return ErrLimitExceeded
 		}
-		if i >= rv.Len() {
-			rv.SetLen(i + 1)
+		if rv.Kind() == reflect.Slice {
+			growSlice(rv, i)
 		}
 		if i < rv.Len() {
 			// Decode into element.
+			d.pushIndex(i)
 			if err = d.value(rv.Index(i)); err != nil {
 				return
 			}
+			d.pop()
 		} else {
 			// Ran out of fixed array: skip.
-			if err = d.unmarshal(&skipper); err != nil {
+			if err = d.skipValue(); err != nil {
 				return
 			}
-			skipper = nil
 		}
 		if d.eos {
 			d.eos = false
@@ -503,34 +703,54 @@ func (d *decodeState) unmarshalStreamedList(rv reflect.Value) (err error) {
 }
 
 func (d *decodeState) unmarshalSizedList(rv reflect.Value, s int) (err error) {
-	var skipper interface{}
 	if rv.Kind() == reflect.Slice {
-		// Grow slice if necessary
-		if s > rv.Cap() {
-			rv.Set(reflect.MakeSlice(rv.Type(), s, s))
+		// Grow slice if necessary, up to the length which can be preallocated.
+		n := d.preallocLen(uint64(s))
+		if n > rv.Cap() {
+			rv.Set(reflect.MakeSlice(rv.Type(), n, n))
 		}
-		if s > rv.Len() {
-			rv.SetLen(s)
+		if n > rv.Len() {
+			rv.SetLen(n)
 		}
 	}
 	for i := 0; i < s; i++ {
+		if rv.Kind() == reflect.Slice {
+			growSlice(rv, i)
+		}
 		if i < rv.Len() {
 			// Decode into element.
+			d.pushIndex(i)
 			if err = d.value(rv.Index(i)); err != nil {
 				return
 			}
+			d.pop()
 		} else {
 			// Ran out of fixed array: skip.
-			if err = d.unmarshal(&skipper); err != nil {
+			if err = d.skipValue(); err != nil {
 				return
 			}
-			skipper = nil
 		}
 	}
 	d.adjustSliceLen(rv, s)
 	return
 }
 
+// growSlice grows the slice rv so that its length is at least i+1.
+func growSlice(rv reflect.Value, i int) {
+	if i >= rv.Cap() {
+		newcap := rv.Cap() + rv.Cap()/2
+		if newcap < 4 {
+			newcap = 4
+		}
+		newv := reflect.MakeSlice(rv.Type(), rv.Len(), newcap)
+		reflect.Copy(newv, rv)
+		rv.Set(newv)
+	}
+	if i >= rv.Len() {
+		rv.SetLen(i + 1)
+	}
+}
+
 func (d *decodeState) adjustSliceLen(rv reflect.Value, s int) {
 	if s < rv.Len() {
 		if rv.Kind() == reflect.Array {
@@ -548,45 +768,39 @@ func (d *decodeState) adjustSliceLen(rv reflect.Value, s int) {
 func (d *decodeState) unmarshalMap(rv reflect.Value) (err error) {
 	var (
 		key      string
-		value    interface{}
 		s        uint64
-		m        map[string]interface{}
+		fields   *structFields
 		isStream bool
+		kv, vv   reflect.Value
 	)
 
-	if rv.Kind() != reflect.Map && rv.Kind() != reflect.Interface {
+	if rv.Kind() != reflect.Map && rv.Kind() != reflect.Interface && rv.Kind() != reflect.Struct {
 		return ErrUnMarshalTypeError
-	} else if rv.Kind() == reflect.Map && rv.Type().Key().Kind() != reflect.String {
+	} else if rv.Kind() == reflect.Map && !isKeyType(rv.Type().Key()) {
+		return ErrUnMarshalTypeError
+	} else if rv.Kind() == reflect.Struct && (rv.Type() == structType || rv.Type() == timeType) {
 		return ErrUnMarshalTypeError
 	}
 
-	if rv.Kind() == reflect.Interface {
-		if rv.NumMethod() != 0 {
-			return ErrUnMarshalTypeError
+	keyv := reflect.ValueOf(&key).Elem()
+	if rv.Kind() == reflect.Struct {
+		fields = cachedTypeFields(rv.Type())
+	} else {
+		if rv.Kind() == reflect.Interface {
+			if rv.NumMethod() != 0 {
+				return ErrUnMarshalTypeError
+			}
+			rv.Set(reflect.ValueOf(make(map[string]interface{})))
+			rv = rv.Elem()
+		} else if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
 		}
-		m = make(map[string]interface{})
-		rv.Set(reflect.ValueOf(m))
-		rv = rv.Elem()
-	} else if rv.IsNil() {
-		rv.Set(reflect.MakeMap(reflect.TypeOf(m)))
+		kv = reflect.New(rv.Type().Key()).Elem()
+		vv = reflect.New(rv.Type().Elem()).Elem()
 	}
 
-	if (d.marker & 0xF0) == mTinyMapStart {
-		s = uint64(d.marker & 0x0F)
-	} else {
-		switch {
-		case d.marker == mMapSize8:
-			s, err = d.readSize(1)
-		case d.marker == mMapSize16:
-			s, err = d.readSize(2)
-		case d.marker == mMapSize32:
-			s, err = d.readSize(4)
-		case d.marker == mMapSizeStream:
-			isStream = true
-		}
-		if err != nil {
-			return
-		}
+	if s, isStream, err = d.readMapSize(); err != nil {
+		return
 	}
 
 	iS := int(s)
@@ -594,79 +808,266 @@ func (d *decodeState) unmarshalMap(rv reflect.Value) (err error) {
 	for {
 		if !isStream && i >= iS {
 			break
+		} else if isStream && d.opts.MaxContainerLength > 0 && i > d.opts.MaxContainerLength {
+			return ErrLimitExceeded
+		}
+		offset := d.cursor
+		if d.peeked {
+			offset--
 		}
-		if err = d.unmarshal(&key); err != nil {
+		if err = d.value(keyv); err != nil {
 			break
 		}
 		if d.eos {
+			d.eos = false
 			break
 		}
-		if err = d.unmarshal(&value); err != nil {
-			break
+		d.pushKey(key)
+		if fields != nil {
+			if f := fields.lookup(key); f != nil {
+				if fv := fieldByIndex(rv, f.index, true); fv.IsValid() {
+					err = d.value(fv)
+				} else {
+					err = ErrUnMarshalTypeError
+				}
+			} else {
+				// Unknown field: skip.
+				err = d.skipValue()
+			}
+			if err != nil {
+				break
+			}
+		} else {
+			// The value is decoded from scratch, as its previous content has been stored in the map.
+			var k reflect.Value
+			if k, err = d.mapKey(kv, key, offset); err != nil {
+				break
+			}
+			vv.Set(reflect.Zero(vv.Type()))
+			if err = d.value(vv); err != nil {
+				break
+			}
+			rv.SetMapIndex(k, vv)
 		}
-		rv.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(value))
+		d.pop()
 
 		i++
 	}
 	return
 }
 
+// isKeyType reports whether the maps whose keys are of type t can be decoded: their keys must either be strings,
+// integers, or implement encoding.TextUnmarshaler, as in encoding/json.
+func isKeyType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
+
+// mapKey converts the map key s, which has been read at offset, into a value of the type of kv. The value kv is
+// reused, unless the type implements encoding.TextUnmarshaler.
+func (d *decodeState) mapKey(kv reflect.Value, s string, offset uint64) (reflect.Value, error) {
+	t := kv.Type()
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		pv := reflect.New(t)
+		if err := pv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+			return reflect.Value{}, err
+		}
+		return pv.Elem(), nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		kv.SetString(s)
+		return kv, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && !kv.OverflowInt(n) {
+			kv.SetInt(n)
+			return kv, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil && !kv.OverflowUint(n) {
+			kv.SetUint(n)
+			return kv, nil
+		}
+	}
+	return reflect.Value{}, d.typeError(d.marker, kv, offset)
+}
+
 func (d *decodeState) unmarshalStruct(rv reflect.Value) (err error) {
 	var (
-		p      []byte
 		st     Structure
 		s      uint64
+		sig    byte
 		fields []interface{}
 	)
 
 	if rv.Kind() != reflect.Struct && rv.Kind() != reflect.Interface {
 		return ErrUnMarshalTypeError
-	} else if rv.Kind() == reflect.Struct {
-		if _, ok := rv.Interface().(Structure); !ok {
+	} else if rv.Kind() == reflect.Interface && rv.NumMethod() != 0 {
+		return ErrUnMarshalTypeError
+	} else if rv.Kind() == reflect.Struct && rv.Type() != structType {
+		if _, ok := signatureOf(rv); !ok {
 			return ErrUnMarshalTypeError
 		}
 	}
 
-	if (d.marker & 0xF0) == mTinyStructStart {
-		s = uint64(d.marker & 0x0F)
-	} else {
-		switch {
-		case d.marker == mStructSize8:
-			s, err = d.readSize(1)
-		case d.marker == mStructSize16:
-			s, err = d.readSize(2)
-		}
-		if err != nil {
-			return
-		}
-	}
-
-	if p, err = d.readBytes(1); err != nil {
+	start := d.cursor
+	if s, sig, err = d.readStructHeader(); err != nil {
 		return
 	}
 
-	fields = make([]interface{}, s)
 	if rv.Kind() == reflect.Interface {
-		if rv.NumMethod() != 0 {
+		if t, ok := registeredType(sig); ok {
+			var v reflect.Value
+			if v, ok, err = d.unmarshalRegistered(t, start, s, sig); ok {
+				rv.Set(v)
+			}
+			if ok || err != nil {
+				return
+			}
+		}
+	} else if rv.Type() != structType {
+		if expected, _ := signatureOf(rv); expected != sig {
 			return ErrUnMarshalTypeError
 		}
-		st.Signature = p[0]
+		return d.unmarshalFields(rv, int(s))
+	}
+
+	fields = make([]interface{}, s)
+	if rv.Kind() == reflect.Interface {
+		st.Signature = sig
 		st.Fields = fields
 		rv.Set(reflect.ValueOf(st))
 		rv = rv.Elem()
 	} else {
-		rv.FieldByName("Signature").Set(reflect.ValueOf(p[0]))
+		rv.FieldByName("Signature").Set(reflect.ValueOf(sig))
 		rv.FieldByName("Fields").Set(reflect.ValueOf(fields))
 	}
 	iS := int(s)
 	for i := 0; i < iS; i++ {
+		d.pushIndex(i)
 		if err = d.unmarshal(&fields[i]); err != nil {
 			return
 		}
+		d.pop()
+	}
+	return
+}
+
+// unmarshalRegistered decodes a structure, whose header has already been read from start in the input, into a new
+// value of the type t registered with its signature. If the structure does not fit t, as another structure may use
+// the same signature, unmarshalRegistered rewinds the input to the fields of the structure and returns false, so that
+// it is decoded as a Structure instead. Errors reading the input are returned as is.
+func (d *decodeState) unmarshalRegistered(t reflect.Type, start, s uint64, sig byte) (reflect.Value, bool, error) {
+	v := reflect.New(t)
+	su, isSU := v.Interface().(StreamUnmarshaler)
+	u, isU := v.Interface().(Unmarshaler)
+	if !isSU && !isU && int(s) != len(cachedTypeFields(t).list) {
+		return reflect.Value{}, false, nil
+	}
+
+	cursor, path, depth, eos := d.cursor, len(d.path), d.depth, d.eos
+	var b bytes.Buffer
+	stream := d.stream
+	if stream != nil {
+		d.stream = io.TeeReader(stream, &b)
+	}
+
+	var err error
+	if isSU {
+		err = d.unmarshalStructStreamUnmarshaler(su, start, s, sig)
+	} else if isU {
+		err = d.unmarshalStructUnmarshaler(u, start, s, sig)
+	} else {
+		err = d.unmarshalFields(v.Elem(), int(s))
+	}
+	d.stream = stream
+	if err == nil {
+		return v.Elem(), true, nil
+	} else if errors.Is(err, io.EOF) || errors.Is(err, ErrLimitExceeded) {
+		return reflect.Value{}, false, err
+	}
+
+	d.cursor, d.path, d.depth, d.eos, d.peeked = cursor, d.path[:path], depth, eos, false
+	if stream != nil {
+		// Replay the bytes read so far. Once they have been read again, the input is read from stream.
+		d.stream = io.MultiReader(bytes.NewReader(b.Bytes()), stream)
+	}
+	return reflect.Value{}, false, nil
+}
+
+// unmarshalFields decodes s structure fields into the exported fields of the Go struct rv, in declaration order.
+// Additional structure fields are discarded, and additional Go struct fields are set to zero values.
+func (d *decodeState) unmarshalFields(rv reflect.Value, s int) (err error) {
+	fields := cachedTypeFields(rv.Type()).list
+	for i := 0; i < s; i++ {
+		if i < len(fields) {
+			d.pushKey(fields[i].name)
+			fv := fieldByIndex(rv, fields[i].index, true)
+			if !fv.IsValid() {
+				return ErrUnMarshalTypeError
+			}
+			if err = d.value(fv); err != nil {
+				return
+			}
+			d.pop()
+		} else {
+			// Ran out of struct fields: skip.
+			if err = d.skipValue(); err != nil {
+				return
+			}
+		}
+	}
+	for i := s; i < len(fields); i++ {
+		if fv := fieldByIndex(rv, fields[i].index, false); fv.IsValid() {
+			fv.Set(reflect.Zero(fv.Type()))
+		}
 	}
 	return
 }
 
+// unmarshalStructUnmarshaler hands a structure to an Unmarshaler once its header has already been read, from start
+// in the input, by replaying the header.
+func (d *decodeState) unmarshalStructUnmarshaler(um Unmarshaler, start, s uint64, sig byte) error {
+	if d.stream == nil {
+		d.cursor = start
+		return d.unmarshalUnmarshaler(um)
+	}
+
+	return um.UnmarshalPS(d.marker, io.MultiReader(bytes.NewReader(d.structHeader(s, sig)), offsetReader{d}))
+}
+
+// unmarshalStructStreamUnmarshaler hands a structure to a StreamUnmarshaler once its header has already been read,
+// from start in the input, by replaying the header.
+func (d *decodeState) unmarshalStructStreamUnmarshaler(su StreamUnmarshaler, start, s uint64, sig byte) error {
+	d.cursor = start
+	if d.stream == nil {
+		return d.unmarshalStreamUnmarshaler(su)
+	}
+
+	stream := d.stream
+	header := d.structHeader(s, sig)
+	d.stream = io.MultiReader(bytes.NewReader(header), stream)
+	err := d.unmarshalStreamUnmarshaler(su)
+	d.stream = stream
+	return err
+}
+
+// structHeader returns the bytes following the marker of a structure of s fields with the given signature.
+func (d *decodeState) structHeader(s uint64, sig byte) []byte {
+	switch d.marker {
+	case mStructSize8:
+		return []byte{byte(s), sig}
+	case mStructSize16:
+		return []byte{byte(s >> 8), byte(s), sig}
+	}
+	return []byte{sig}
+}
+
 func (d *decodeState) unmarshalBytes(rv reflect.Value) (err error) {
 	var (
 		p []byte
@@ -678,44 +1079,59 @@ func (d *decodeState) unmarshalBytes(rv reflect.Value) (err error) {
 		return ErrUnMarshalTypeError
 	}
 
-	switch {
-	case d.marker == mBytesSize8:
-		s, err = d.readSize(1)
-	case d.marker == mBytesSize16:
-		s, err = d.readSize(2)
-	case d.marker == mBytesSize32:
-		s, err = d.readSize(4)
-	}
-	if err != nil {
-		return
-	}
-	if p, err = d.readBytes(s); err != nil {
+	if p, err = d.readByteArray(); err != nil {
 		return
 	}
+	s = uint64(len(p))
 
+	// The bytes read from a stream are not shared, while the bytes of Unmarshal input are only shared if the
+	// options allow it.
+	alias := d.stream != nil || d.opts.AliasBytes
 	pV := reflect.ValueOf(p)
 	if rv.Kind() == reflect.Interface {
 		if rv.NumMethod() != 0 {
 			return ErrUnMarshalTypeError
 		}
+		if !alias {
+			pV = reflect.ValueOf(append(make([]byte, 0, len(p)), p...))
+		}
 		rv.Set(pV)
 		return
 	}
 
 	iS := int(s)
 	if rv.Kind() == reflect.Slice {
+		if alias && pV.Type().AssignableTo(rv.Type()) {
+			rv.Set(pV)
+			return
+		}
 		// Grow slice if necessary
 		if iS > rv.Cap() {
-			rv.Set(pV)
+			rv.Set(reflect.MakeSlice(rv.Type(), iS, iS))
 		}
 		if iS != rv.Len() {
 			rv.SetLen(iS)
 		}
 	}
+	if rv.Type().Elem() != pV.Type().Elem() {
+		// Named byte types cannot be copied directly.
+		for i := 0; i < iS && i < rv.Len(); i++ {
+			rv.Index(i).SetUint(uint64(p[i]))
+		}
+		return
+	}
 	reflect.Copy(rv, pV)
 	return
 }
 
+// toString returns p as a string, which aliases p if the options of d allow it.
+func (d *decodeState) toString(p []byte) string {
+	if d.opts.AliasStrings && len(p) > 0 {
+		return *(*string)(unsafe.Pointer(&p))
+	}
+	return string(p)
+}
+
 func (d *decodeState) unmarshalBool(rv reflect.Value) error {
 	var b bool
 	if rv.Kind() != reflect.Bool && rv.Kind() != reflect.Interface {
@@ -737,23 +1153,18 @@ func (d *decodeState) unmarshalBool(rv reflect.Value) error {
 }
 
 func (d *decodeState) unmarshalFloat(rv reflect.Value) (err error) {
-	var (
-		f float64
-		p []byte
-	)
-
-	if p, err = d.readBytes(8); err != nil {
+	var f float64
+	if f, err = d.readFloat(); err != nil {
 		return
 	}
 
-	f = math.Float64frombits(binary.BigEndian.Uint64(p))
 	switch rv.Kind() {
 	default:
 		return ErrUnMarshalTypeError
 	case reflect.Interface:
 		rv.Set(reflect.ValueOf(f))
 		return nil
-	case reflect.Float32:
+	case reflect.Float32, reflect.Float64:
 		if rv.OverflowFloat(f) {
 			return ErrUnMarshalTypeError
 		}
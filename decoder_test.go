@@ -2,6 +2,9 @@ package packstream
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 	"math"
 	"reflect"
 	"strconv"
@@ -57,7 +60,7 @@ func TestIndirect(t *testing.T) {
 		um **marshaller
 	)
 
-	if marshaller, v := indirect(reflect.ValueOf(&p3), false); marshaller != nil {
+	if marshaller, _, v := indirect(reflect.ValueOf(&p3), false); marshaller != nil {
 		t.Errorf("unmarshaller should be nil, got %v.", marshaller)
 	} else if _, ok := v.Interface().(int); !ok {
 		t.Errorf("value should be an int, got %v.", v.Interface())
@@ -69,13 +72,13 @@ func TestIndirect(t *testing.T) {
 	}
 
 	p3 = nil
-	if marshaller, v := indirect(reflect.ValueOf(&p3), true); marshaller != nil {
+	if marshaller, _, v := indirect(reflect.ValueOf(&p3), true); marshaller != nil {
 		t.Errorf("unmarshaller should be nil, got %v.", marshaller)
 	} else if v.Kind() != reflect.Ptr {
 		t.Errorf("value should be an int pointer, got %v.", v.Interface())
 	}
 
-	if marshaller, _ := indirect(reflect.ValueOf(&um), false); marshaller == nil {
+	if marshaller, _, _ := indirect(reflect.ValueOf(&um), false); marshaller == nil {
 		t.Error("unmarshaller should not be nil")
 	}
 }
@@ -124,7 +127,7 @@ func TestUnmarshal_String(t *testing.T) {
 
 	s = math.MaxUint16 + 1
 	longStr = []byte{mStringSize32}
-	longStr = append(longStr, packedUint32Size(uint32(s))...)
+	longStr = binary.BigEndian.AppendUint32(longStr, uint32(s))
 	longStr = append(longStr, make([]byte, s)...)
 	if err := Unmarshal(longStr, &str); err != nil {
 		t.Errorf("error while unmarshaling string of length %v: %v", s, err)
@@ -167,7 +170,7 @@ func TestUnmarshal_List(t *testing.T) {
 
 	s = math.MaxUint16 + 1
 	longList = []byte{mListSize32}
-	longList = append(longList, packedUint32Size(uint32(s))...)
+	longList = binary.BigEndian.AppendUint32(longList, uint32(s))
 	longList = append(longList, make([]byte, s)...)
 	if err := Unmarshal(longList, &l); err != nil {
 		t.Errorf("error while unmarshaling list of length %v: %v", s, err)
@@ -186,6 +189,12 @@ func TestUnmarshal_List(t *testing.T) {
 		t.Errorf("error while unmarshaling list of length %v, got length of %v, expected %v.", s, len(l), s)
 	}
 
+	var v interface{}
+	if err := Unmarshal(longList, &v); err != nil {
+		t.Errorf("error while unmarshaling list of length %v into an interface: %v", s, err)
+	} else if l, ok := v.([]interface{}); !ok || len(l) != s {
+		t.Errorf("error while unmarshaling list of length %v into an interface, got %v.", s, v)
+	}
 }
 
 func getEncodedMap(t *testing.T, s int) []byte {
@@ -254,6 +263,103 @@ func TestUnmarshal_Map(t *testing.T) {
 	}
 }
 
+func TestUnmarshal_TypedMap(t *testing.T) {
+	type testKey string
+	type testValue struct {
+		Name string
+		Tags []string
+	}
+	var (
+		mi map[string]int64
+		ms map[testKey][]string
+		mv map[string]testValue
+		lm []map[string]float64
+	)
+
+	decode := func(v, target interface{}) {
+		t.Helper()
+		p, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Unmarshal(p, target); err != nil {
+			t.Error(err)
+		}
+	}
+
+	decode(map[string]interface{}{"a": 1, "b": 2}, &mi)
+	if !reflect.DeepEqual(mi, map[string]int64{"a": 1, "b": 2}) {
+		t.Errorf("invalid decoded map, got %v", mi)
+	}
+
+	// The values of the entries do not share their backing arrays.
+	decode(map[string]interface{}{"a": []string{"x", "y"}, "b": []string{"z"}}, &ms)
+	if !reflect.DeepEqual(ms, map[testKey][]string{"a": {"x", "y"}, "b": {"z"}}) {
+		t.Errorf("invalid decoded map, got %v", ms)
+	}
+
+	decode(map[string]interface{}{"a": testValue{"x", []string{"y"}}}, &mv)
+	if !reflect.DeepEqual(mv, map[string]testValue{"a": {"x", []string{"y"}}}) {
+		t.Errorf("invalid decoded map, got %v", mv)
+	}
+
+	decode([]interface{}{map[string]interface{}{"a": 0.5}, nil}, &lm)
+	if !reflect.DeepEqual(lm, []map[string]float64{{"a": 0.5}, nil}) {
+		t.Errorf("invalid decoded list of maps, got %v", lm)
+	}
+
+	var typeErr *UnmarshalTypeError
+	if err := Unmarshal([]byte{0xA1, 0x81, 'a', 0x81, 'b'}, &mi); !errors.As(err, &typeErr) {
+		t.Errorf("decoding a string into an int64 map value should fail, got %v", err)
+	} else if typeErr.Path != "a" {
+		t.Errorf("invalid path of the type error, got %q", typeErr.Path)
+	}
+}
+
+func TestUnmarshal_MapKeys(t *testing.T) {
+	var (
+		mi map[int8]string
+		mu map[uint]string
+		mt map[testTextKey]string
+	)
+	if err := Unmarshal([]byte{0xA2, 0x82, '-', '1', 0x81, 'a', 0x81, '2', 0x81, 'b'}, &mi); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(mi, map[int8]string{-1: "a", 2: "b"}) {
+		t.Errorf("invalid decoded map, got %v", mi)
+	}
+
+	if err := Unmarshal([]byte{0xA1, 0x81, '7', 0x81, 'a'}, &mu); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(mu, map[uint]string{7: "a"}) {
+		t.Errorf("invalid decoded map, got %v", mu)
+	}
+
+	if err := Unmarshal([]byte{0xA1, 0x83, '1', '-', '2', 0x81, 'a'}, &mt); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(mt, map[testTextKey]string{{1, 2}: "a"}) {
+		t.Errorf("invalid decoded map, got %v", mt)
+	}
+	if err := Unmarshal([]byte{0xA1, 0x81, '1', 0x81, 'a'}, &mt); err == nil || err.Error() != "invalid key" {
+		t.Errorf("the error of UnmarshalText should be returned, got %v", err)
+	}
+
+	// Keys which are not integers, or overflow the key type.
+	var typeErr *UnmarshalTypeError
+	for _, tc := range []struct {
+		p      []byte
+		offset int64
+	}{
+		{[]byte{0xA1, 0x81, 'a', 0x81, 'a'}, 1},
+		{[]byte{0xA2, 0x81, '1', 0x81, 'a', 0x83, '1', '2', '8', 0x81, 'b'}, 5},
+	} {
+		if err := Unmarshal(tc.p, &mi); !errors.As(err, &typeErr) {
+			t.Errorf("decoding an invalid integer key should fail, got %v", err)
+		} else if typeErr.GoType != reflect.TypeOf(int8(0)) || typeErr.Offset != tc.offset {
+			t.Errorf("invalid type error, got %v", err)
+		}
+	}
+}
+
 func TestUnmarshal_Structure(t *testing.T) {
 	var st Structure
 
@@ -288,7 +394,7 @@ func TestUnmarshal_Bytes(t *testing.T) {
 
 	s = math.MaxUint16 + 1
 	b = []byte{mBytesSize32}
-	b = append(b, packedUint32Size(uint32(s))...)
+	b = binary.BigEndian.AppendUint32(b, uint32(s))
 	for i := 0; i < s; i++ {
 		b = append(b, 42)
 	}
@@ -308,6 +414,44 @@ func TestUnmarshal_Unmarshaller(t *testing.T) {
 	}
 }
 
+func TestUnmarshal_StreamUnmarshaler(t *testing.T) {
+	encoded := []byte{0x93, 0x92, 0x81, 'a', 0x92, 0x01, 0x02, 0x92, 0x81, 'b', mNull, mNull}
+	expected := []*testPair{{"a", []int64{1, 2}}, {Name: "b"}, nil}
+
+	var v []*testPair
+	if err := Unmarshal(encoded, &v); err != nil {
+		t.Errorf("error while unmarshaling stream unmarshalers: %v", err)
+	} else if !reflect.DeepEqual(v, expected) {
+		t.Errorf("invalid stream unmarshalers, got %#v", v)
+	}
+
+	dec := NewDecoder(bytes.NewReader(append(encoded, 0x2A)))
+	v = nil
+	var i int
+	if err := dec.Decode(&v); err != nil {
+		t.Errorf("error while decoding stream unmarshalers: %v", err)
+	} else if !reflect.DeepEqual(v, expected) {
+		t.Errorf("invalid stream unmarshalers, got %#v", v)
+	} else if err := dec.Decode(&i); err != nil || i != 0x2A {
+		t.Errorf("the value after stream unmarshalers should be decoded, got %v, %v", i, err)
+	}
+
+	// The errors of the nested values keep their offset and path.
+	encoded = []byte{0x92, 0x92, 0x81, 'a', 0x91, 0x01, 0x92, 0x81, 'b', 0x91, 0x81, 'x'}
+	expectedErr := &UnmarshalTypeError{Marker: 0x81, GoType: reflect.TypeOf(int64(0)), Offset: 10, Path: "[1][0]"}
+	var pairs []testPair
+	if err := Unmarshal(encoded, &pairs); !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("invalid error, got %#v, expected %#v", err, expectedErr)
+	}
+	if err := NewDecoder(bytes.NewReader(encoded)).Decode(&pairs); !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("invalid error, got %#v, expected %#v", err, expectedErr)
+	}
+
+	if err := (DecoderOptions{MaxDepth: 1}).Unmarshal(encoded, &pairs); err != ErrLimitExceeded {
+		t.Errorf("the nested values should be decoded within the limits, got %v", err)
+	}
+}
+
 func TestUnmarshal_Int(t *testing.T) {
 	var (
 		i8   int8
@@ -377,6 +521,12 @@ func TestUnmarshal_Float(t *testing.T) {
 		t.Errorf("error while unmarshaling int64, got %v, expected %v.", f32, -1.1)
 	}
 
+	var f64 float64
+	if err := Unmarshal([]byte{mFloat64, 0xBF, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A}, &f64); err != nil {
+		t.Error(err)
+	} else if f64 != -1.1 {
+		t.Errorf("error while unmarshaling float64, got %v, expected %v.", f64, -1.1)
+	}
 }
 
 func TestUnmarshal_Time(t *testing.T) {
@@ -400,3 +550,228 @@ func TestUnmarshal_Time(t *testing.T) {
 		t.Errorf("time should be a zero value, got %v.", tm)
 	}
 }
+
+func TestDecoder_SetTimeFormat(t *testing.T) {
+	var b bytes.Buffer
+	tm := time.Date(2016, time.January, 02, 12, 42, 43, 5e6, time.FixedZone("", 3600))
+
+	enc := NewEncoder(&b)
+	for _, format := range []TimeFormat{TimeUnixMilli, TimeISO8601, TimeStructure} {
+		enc.SetTimeFormat(format)
+		enc.Encode(tm)
+	}
+
+	dec := NewDecoder(&b)
+	dec.SetTimeFormat(TimeUnixMilli)
+	for _, format := range []TimeFormat{TimeUnixMilli, TimeISO8601, TimeStructure} {
+		var decoded time.Time
+		if err := dec.Decode(&decoded); err != nil {
+			t.Errorf("format %v: %v", format, err)
+		} else if !decoded.Equal(tm) {
+			t.Errorf("format %v: got %v, expected %v", format, decoded, tm)
+		} else if _, offset := decoded.Zone(); format != TimeUnixMilli && offset != 3600 {
+			t.Errorf("format %v: time zone offset should be kept, got %v", format, offset)
+		}
+	}
+
+	var decoded time.Time
+	if err := Unmarshal([]byte{0x81, 0x61}, &decoded); !errors.Is(err, ErrUnMarshalTypeError) {
+		t.Errorf("error should be ErrUnMarshalTypeError, got %v", err)
+	}
+}
+
+func TestUnmarshal_Struct(t *testing.T) {
+	var v testStruct
+
+	m := map[string]interface{}{"embedded": "e", "NAME": "n", "count": 42, "Skipped": "s", "unknown": []interface{}{1, 2}}
+	if b, err := Marshal(m); err != nil {
+		t.Fatal(err)
+	} else if err := Unmarshal(b, &v); err != nil {
+		t.Errorf("error while unmarshaling struct: %v", err)
+	} else if v.Embedded != "e" || v.Name != "n" || v.Count != 42 {
+		t.Errorf("invalid decoded struct, got %+v", v)
+	} else if v.Skipped != "" || v.Inner.Name != "" {
+		t.Errorf("ignored fields should not be decoded, got %+v", v)
+	}
+
+	if err := Unmarshal([]byte{0xA1, 0x84, 0x4E, 0x61, 0x6D, 0x65, 0x2A}, &v); err == nil {
+		t.Error("error should not be nil when a field has an inappropriate type.")
+	}
+}
+
+func TestUnmarshal_StreamedListIntoArray(t *testing.T) {
+	var v [2]int64
+	if err := Unmarshal([]byte{0xD7, 0x01, 0x02, 0x92, 0x01, 0x02, 0x03, 0xDF}, &v); err != nil {
+		t.Error(err)
+	} else if v != [2]int64{1, 2} {
+		t.Errorf("invalid decoded array, got %v", v)
+	}
+}
+
+func TestUnmarshal_StreamedListOfTimes(t *testing.T) {
+	var v []time.Time
+	if err := Unmarshal([]byte{0xD7, 0x01, 0x02, 0xDF}, &v); err != nil {
+		t.Error(err)
+	} else if len(v) != 2 || !v[0].Equal(time.Unix(0, 1)) || !v[1].Equal(time.Unix(0, 2)) {
+		t.Errorf("invalid decoded times, got %v", v)
+	}
+
+	var m []marshaller
+	if err := Unmarshal([]byte{0xD7, 0x01, 0xDF}, &m); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(m, []marshaller{42}) {
+		t.Errorf("invalid decoded unmarshalers, got %v", m)
+	}
+}
+
+func TestDecoder_More(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	enc.Encode(1)
+	enc.Encode("a")
+	enc.BeginList()
+	enc.Encode(2)
+	enc.End()
+
+	var (
+		values  []interface{}
+		offsets []int64
+	)
+	dec := NewDecoder(&b)
+	for dec.More() {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, v)
+		offsets = append(offsets, dec.InputOffset())
+	}
+	if !reflect.DeepEqual(values, []interface{}{int64(1), "a", []interface{}{int64(2)}}) {
+		t.Errorf("invalid decoded values, got %v", values)
+	}
+	if !reflect.DeepEqual(offsets, []int64{1, 3, 6}) {
+		t.Errorf("invalid input offsets, got %v", offsets)
+	}
+	if err := dec.Decode(new(interface{})); err != io.EOF {
+		t.Errorf("error should be io.EOF at the end of the input, got %v", err)
+	}
+
+	// More also ends the elements of a streamed list.
+	dec = NewDecoder(bytes.NewReader([]byte{mListSizeStream, 0x01, 0x02, mEndOfStream}))
+	n := 0
+	if _, err := dec.ReadListHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for ; dec.More(); n++ {
+		if err := dec.Skip(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 2 {
+		t.Errorf("invalid number of streamed elements, got %v", n)
+	} else if err := dec.ReadEndOfStream(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecoder_Buffered(t *testing.T) {
+	rd := bytes.NewReader([]byte{0x01, 0x02, 0x03})
+	dec := NewDecoder(rd)
+	if p, _ := io.ReadAll(dec.Buffered()); len(p) != 0 {
+		t.Errorf("nothing should be buffered, got % #X", p)
+	}
+	var i int64
+	if err := dec.Decode(&i); err != nil {
+		t.Fatal(err)
+	}
+	if !dec.More() {
+		t.Fatal("more values should be available")
+	} else if dec.InputOffset() != 1 {
+		t.Errorf("invalid input offset, got %v", dec.InputOffset())
+	}
+	if p, err := io.ReadAll(io.MultiReader(dec.Buffered(), rd)); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(p, []byte{0x02, 0x03}) {
+		t.Errorf("invalid remaining input, got % #X", p)
+	}
+}
+
+func TestUnmarshalNoCopy(t *testing.T) {
+	type testByte byte
+	var (
+		b []byte
+		i interface{}
+		s string
+	)
+	decode := func(unmarshal func([]byte, interface{}) error, v ...interface{}) {
+		t.Helper()
+		// The input is overwritten once decoded.
+		p := []byte{0x93, mBytesSize8, 0x02, 'a', 'b', mBytesSize8, 0x01, 'c', 0x81, 'd'}
+		if err := unmarshal(p, &v); err != nil {
+			t.Fatal(err)
+		}
+		for i := range p {
+			p[i] = 'z'
+		}
+	}
+
+	decode(Unmarshal, &b, &i, &s)
+	if string(b) != "ab" || string(i.([]byte)) != "c" || s != "d" {
+		t.Errorf("decoded values should be copied, got %q, %q, %q", b, i, s)
+	}
+
+	decode(UnmarshalNoCopy, &b, &i, &s)
+	if string(b) != "zz" || string(i.([]byte)) != "z" || s != "d" {
+		t.Errorf("decoded byte arrays should alias the input, got %q, %q, %q", b, i, s)
+	}
+
+	decode(DecoderOptions{AliasStrings: true}.Unmarshal, &b, &i, &s)
+	if string(b) != "ab" || string(i.([]byte)) != "c" || s != "z" {
+		t.Errorf("decoded strings should alias the input, got %q, %q, %q", b, i, s)
+	}
+
+	var e []testByte
+	decode(UnmarshalNoCopy, &e, &i, &s)
+	if !reflect.DeepEqual(e, []testByte{'a', 'b'}) {
+		t.Errorf("byte arrays of named bytes should be copied, got %v", e)
+	}
+}
+
+func BenchmarkUnmarshal_ListOfMaps(b *testing.B) {
+	p, err := Marshal(benchListOfMaps())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var v []map[string]interface{}
+		if err := Unmarshal(p, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal_Structures(b *testing.B) {
+	nodes, items := benchStructures()
+	pn, err := Marshal(nodes)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pi, err := Marshal(items)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var (
+			vn []Node
+			vi []benchItem
+		)
+		if err := Unmarshal(pn, &vn); err != nil {
+			b.Fatal(err)
+		}
+		if err := Unmarshal(pi, &vi); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,17 +1,31 @@
 package packstream
 
 import (
-	"bytes"
-	"encoding/binary"
+	"encoding"
 	"io"
 	"math"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
 // Encoder can write go values to an output stream, encoding them in packstream format.
+//
+// An Encoder accumulates the encoding of each value in an internal buffer. Unless it is buffered, the buffer is
+// written to the output stream with a single Write call at the end of each call to Encode, or to a method writing a
+// token.
 type Encoder struct {
-	wr io.Writer
+	wr         io.Writer
+	streams    int
+	timeFormat TimeFormat
+	buf        []byte
+	buffered   bool
+	encoding   bool
+	start      int
+	threshold  int
+	sortKeys   bool
 }
 
 // NewEncoder returns a new encoder that writes to wr.
@@ -19,12 +33,31 @@ func NewEncoder(wr io.Writer) *Encoder {
 	return &Encoder{wr: wr}
 }
 
+// NewBufferedEncoder returns a new encoder that writes to wr only when its Flush method is called, or when its
+// buffer reaches threshold bytes, if threshold is positive. Flush must be called once all values are encoded.
+func NewBufferedEncoder(wr io.Writer, threshold int) *Encoder {
+	return &Encoder{wr: wr, buffered: true, threshold: threshold}
+}
+
+// SetTimeFormat sets the representation of the time.Time values encoded by e. The default is TimeUnixNano.
+func (e *Encoder) SetTimeFormat(f TimeFormat) {
+	e.timeFormat = f
+}
+
+// SetSortMapKeys sets whether the entries of maps, including the Go structs encoded as maps, are encoded by e in the
+// order of their keys, rather than in the random order of Go maps and the declaration order of struct fields.
+// Sorting the keys makes the encoding of equal values identical, at the cost of some allocations.
+func (e *Encoder) SetSortMapKeys(on bool) {
+	e.sortKeys = on
+}
+
 /*
 Marshal returns the packstream encoding of v.
 
 Marshal traverses the value v recursively. If an encountered value is nil, then it encodes the nil value.
 If an encountered value implements the Marshaler interface and is not a nil pointer, Marshal calls its MarshalPS method
-to produce packstream bytes.
+to produce packstream bytes. If it implements the StreamMarshaler interface, Marshal calls its EncodePS method with
+the Encoder, which can then encode the nested values.
 
 Marshal can encode the following go values:
 	nil
@@ -35,190 +68,304 @@ Marshal can encode the following go values:
 	string
 	[]byte
 	[]interface{}
-	map[string]interface{}
+	maps
 	Structure
 	time.Time
+	structs
+	channels
+
+Packstream map keys are strings: the keys of a Go map must either be strings, integers, which are formatted in
+decimal, or implement encoding.TextMarshaler, as in encoding/json.
+
+A channel is encoded as a streamed list of the values received from it, until it is closed. Encoding a channel
+therefore blocks until it is closed, and a nil channel is encoded as null. Streamed lists and maps can also be
+written incrementally with the BeginList, BeginMap and End methods of an Encoder.
+
+A Go struct implementing the Signer interface, or whose type has been registered with RegisterStructure, is
+encoded as a packstream structure. Its exported fields are encoded positionally, in declaration order, following the
+same visibility rules as described below for maps; only the "-" tag option applies.
+
+Any other Go struct is encoded as a packstream map. Each exported struct field becomes a map entry, using the field
+name as the key, unless the field is omitted for one of the reasons given below.
+
+The encoding of each struct field can be customized by the format string stored under the "packstream" key in the
+struct field's tag. The format string gives the name of the field, possibly followed by a comma-separated list of
+options. The name may be empty in order to specify options without overriding the default field name.
+
+The "omitempty" option specifies that the field should be omitted from the encoding if the field has an empty value,
+defined as false, 0, a nil pointer, a nil interface value, and any empty array, slice, map, or string.
+As a special case, if the field tag is "-", the field is always omitted.
+
+	// Field appears in packstream as key "myName".
+	Field int `packstream:"myName"`
+
+	// Field appears in packstream as key "myName" and is omitted if its value is empty.
+	Field int `packstream:"myName,omitempty"`
+
+	// Field is ignored by this package.
+	Field int `packstream:"-"`
+
+Anonymous struct fields are usually encoded as if their inner exported fields were fields in the outer struct,
+subject to the usual Go visibility rules amended as in encoding/json: a field with a packstream tag wins over an
+untagged one at the same depth, and conflicting fields are ignored. An anonymous struct field with a name given in
+its tag is treated as having that name, rather than being anonymous.
 
 To marshal a time.Time, it stores the int64 returned by time.UnixNano(). If the time is a zero value, it stores 0.
+Other representations can be selected with the SetTimeFormat method of an Encoder.
 */
 func Marshal(v interface{}) (p []byte, err error) {
-	var b bytes.Buffer
-	e := NewEncoder(&b)
-	if err = e.Encode(v); err != nil {
-		return
+	if p, err = AppendMarshal(nil, v); err != nil {
+		p = nil
+	}
+	return
+}
+
+// MarshalCanonical is like Marshal, except that the entries of maps, including the Go structs encoded as maps, are
+// encoded in the byte order of their keys, so that equal values are always encoded as the same bytes.
+// The bytes returned by the MarshalPS method of Marshaler values are written as is.
+func MarshalCanonical(v interface{}) (p []byte, err error) {
+	if p, err = appendMarshal(nil, v, true); err != nil {
+		p = nil
 	}
-	p = b.Bytes()
 	return
 }
 
 // Encode writes a Go value to the underlying writer, encoding them in packstream format.
 //
 // See the documentation for Marshal for details about the conversion of Go values to packstream.
+// If encoding v fails, the part of its encoding which is still buffered is discarded. A prefix of the encoding may
+// however have been written already: by a buffered encoder reaching its threshold, or by an encoder streaming the
+// values received from a channel.
 func (e *Encoder) Encode(v interface{}) (err error) {
+	encoding, streams := e.encoding, e.streams
+	e.encoding = true
+	if !encoding {
+		e.start = len(e.buf)
+	}
 	if v == nil {
 		err = e.marshalNull()
 	} else {
 		err = e.marshal(reflect.ValueOf(v))
 	}
-	return
+	e.encoding = encoding
+	if err != nil && !encoding {
+		// Drop the streamed lists and maps left open by v.
+		e.buf, e.streams = e.buf[:e.start], streams
+	}
+	return e.done(err)
 }
 
-func (e *Encoder) marshal(rv reflect.Value) (err error) {
-	for {
-		if rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Slice || rv.Kind() == reflect.Map ||
-			rv.Kind() == reflect.Interface {
-			if rv.IsNil() {
-				err = e.marshalNull()
-				return
-			}
-		}
-		if rv.Kind() == reflect.Ptr {
-			rv = rv.Elem()
-		} else {
-			break
-		}
+func (e *Encoder) marshal(rv reflect.Value) error {
+	return typeEncoder(rv.Type())(e, rv)
+}
+
+// encoderFunc encodes a value of a given Go type.
+type encoderFunc func(e *Encoder, rv reflect.Value) error
+
+var (
+	streamMarshalerType = reflect.TypeOf((*StreamMarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// encoderCache holds the encoderFunc of the Go types, as a map[reflect.Type]encoderFunc, so that the encoding of a
+// type is planned only once.
+var encoderCache sync.Map
+
+// typeEncoder returns the encoderFunc of the Go type t.
+func typeEncoder(t reflect.Type) encoderFunc {
+	if f, ok := encoderCache.Load(t); ok {
+		return f.(encoderFunc)
 	}
 
-	if rv.Kind() == reflect.Interface {
-		if m, ok := rv.Interface().(Marshaler); ok {
-			err = e.marshalMarshaler(m)
-			return
-		}
-		return e.marshal(rv.Elem())
+	// A recursive type refers to its own encoderFunc while it is being built: store an indirect func, waiting for
+	// the real one, until it is done.
+	var (
+		wg sync.WaitGroup
+		f  encoderFunc
+	)
+	wg.Add(1)
+	fi, loaded := encoderCache.LoadOrStore(t, encoderFunc(func(e *Encoder, rv reflect.Value) error {
+		wg.Wait()
+		return f(e, rv)
+	}))
+	if loaded {
+		return fi.(encoderFunc)
 	}
 
-	switch rv.Kind() {
-	default:
-		err = ErrMarshalTypeError
+	f = newTypeEncoder(t, true)
+	wg.Done()
+	encoderCache.Store(t, f)
+	return f
+}
+
+// resetEncoderCache drops the planned encodings, which depend on the registered structures.
+func resetEncoderCache() {
+	encoderCache.Range(func(t, _ interface{}) bool {
+		encoderCache.Delete(t)
+		return true
+	})
+}
+
+// newTypeEncoder builds the encoderFunc of the Go type t. If allowAddr is true, the encoderFunc also checks whether
+// the pointer methods of addressable values implement Marshaler.
+func newTypeEncoder(t reflect.Type, allowAddr bool) encoderFunc {
+	if t.Kind() != reflect.Interface && t.Implements(streamMarshalerType) {
+		return streamMarshalerEncoder
+	}
+	if t.Kind() != reflect.Ptr && allowAddr && reflect.PtrTo(t).Implements(streamMarshalerType) {
+		return newCondAddrEncoder(addrStreamMarshalerEncoder, newTypeEncoder(t, false))
+	}
+	if t.Kind() != reflect.Interface && t.Implements(marshalerType) {
+		return marshalerEncoder
+	}
+	if t.Kind() != reflect.Ptr && allowAddr && reflect.PtrTo(t).Implements(marshalerType) {
+		return newCondAddrEncoder(addrMarshalerEncoder, newTypeEncoder(t, false))
+	}
+
+	switch t.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8,
 		reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		err = e.marshalInt(rv)
+		return (*Encoder).marshalInt
 	case reflect.Float32, reflect.Float64:
-		err = e.marshalFloat(rv)
+		return (*Encoder).marshalFloat
 	case reflect.Bool:
-		err = e.marshalBool(rv)
+		return (*Encoder).marshalBool
 	case reflect.String:
-		err = e.marshalString(rv)
+		return (*Encoder).marshalString
+	case reflect.Interface:
+		return interfaceEncoder
+	case reflect.Ptr:
+		return ptrEncoder{typeEncoder(t.Elem())}.encode
 	case reflect.Slice:
-		if rv.Type().Elem().Kind() == reflect.Uint8 {
-			err = e.marshalByteSlice(rv)
-		} else {
-			err = e.marshalList(rv)
+		if t.Elem().Kind() == reflect.Uint8 {
+			return (*Encoder).marshalByteSlice
+		}
+		return listEncoder{typeEncoder(t.Elem())}.encode
+	case reflect.Chan:
+		if t.ChanDir()&reflect.RecvDir != 0 {
+			return chanEncoder{typeEncoder(t.Elem())}.encode
 		}
 	case reflect.Map:
-		if rv.Type().Key().Kind() != reflect.String {
-			err = ErrMarshalTypeError
-		} else {
-			err = e.marshalMap(rv)
+		switch t.Key().Kind() {
+		case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint,
+			reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return mapEncoder{typeEncoder(t.Elem())}.encode
 		}
-	case reflect.Struct:
-		typ := rv.Type()
-		if typ == structType {
-			err = e.marshalStruct(rv)
-		} else if typ.PkgPath() == "time" && typ.Name() == "Time" {
-			err = e.marshalTime(rv)
-		} else {
-			err = ErrMarshalTypeError
+		if t.Key().Implements(textMarshalerType) {
+			return mapEncoder{typeEncoder(t.Elem())}.encode
 		}
+	case reflect.Struct:
+		return newStructEncoder(t)
 	}
-	return
+	return unsupportedTypeEncoder
 }
 
-func (e *Encoder) marshalString(rv reflect.Value) (err error) {
-	p := []byte(rv.String())
-	n := len(p)
-	switch {
-	default:
-		return ErrMarshalValueTooLarge
-	case n < maxInt4:
-		if _, err = e.wr.Write(tinyStringSizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint8:
-		if _, err = e.wr.Write([]byte{mStringSize8}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint8Sizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint16:
-		if _, err = e.wr.Write([]byte{mStringSize16}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint16Sizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint32:
-		if _, err = e.wr.Write([]byte{mStringSize32}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint32Size(uint32(n))); err != nil {
-			return
-		}
+func marshalerEncoder(e *Encoder, rv reflect.Value) error {
+	if k := rv.Kind(); (k == reflect.Ptr || k == reflect.Slice || k == reflect.Map) && rv.IsNil() {
+		return e.marshalNull()
 	}
-	_, err = e.wr.Write(p)
-	return
+	return e.marshalMarshaler(rv.Interface().(Marshaler))
 }
 
-func (e *Encoder) marshalByteSlice(rv reflect.Value) (err error) {
-	p := rv.Bytes()
-	n := len(p)
-	switch {
-	default:
-		return ErrMarshalValueTooLarge
-	case n <= math.MaxUint8:
-		if _, err = e.wr.Write([]byte{mBytesSize8}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint8Sizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint16:
-		if _, err = e.wr.Write([]byte{mBytesSize16}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint16Sizes[n]); err != nil {
-			return
+func addrMarshalerEncoder(e *Encoder, rv reflect.Value) error {
+	return e.marshalMarshaler(rv.Addr().Interface().(Marshaler))
+}
+
+func streamMarshalerEncoder(e *Encoder, rv reflect.Value) error {
+	if k := rv.Kind(); (k == reflect.Ptr || k == reflect.Slice || k == reflect.Map) && rv.IsNil() {
+		return e.marshalNull()
+	}
+	return e.marshalStreamMarshaler(rv.Interface().(StreamMarshaler))
+}
+
+func addrStreamMarshalerEncoder(e *Encoder, rv reflect.Value) error {
+	return e.marshalStreamMarshaler(rv.Addr().Interface().(StreamMarshaler))
+}
+
+// newCondAddrEncoder returns an encoderFunc which uses canAddrEnc for addressable values, and elseEnc otherwise.
+func newCondAddrEncoder(canAddrEnc, elseEnc encoderFunc) encoderFunc {
+	return func(e *Encoder, rv reflect.Value) error {
+		if rv.CanAddr() {
+			return canAddrEnc(e, rv)
 		}
-	case n <= math.MaxUint32:
-		if _, err = e.wr.Write([]byte{mBytesSize32}); err != nil {
-			return
+		return elseEnc(e, rv)
+	}
+}
+
+func unsupportedTypeEncoder(e *Encoder, rv reflect.Value) error {
+	return &UnsupportedTypeError{rv.Type()}
+}
+
+func interfaceEncoder(e *Encoder, rv reflect.Value) error {
+	if rv.IsNil() {
+		return e.marshalNull()
+	}
+	return e.marshal(rv.Elem())
+}
+
+// ptrEncoder encodes the values pointed to with elemEnc.
+type ptrEncoder struct {
+	elemEnc encoderFunc
+}
+
+func (pe ptrEncoder) encode(e *Encoder, rv reflect.Value) error {
+	if rv.IsNil() {
+		return e.marshalNull()
+	}
+	return pe.elemEnc(e, rv.Elem())
+}
+
+// newStructEncoder builds the encoderFunc of the Go struct type t.
+func newStructEncoder(t reflect.Type) encoderFunc {
+	switch t {
+	case structType:
+		return (*Encoder).marshalStruct
+	case timeType:
+		return (*Encoder).marshalTime
+	}
+
+	fields := cachedTypeFields(t).list
+	se := structEncoder{fields, make([]encoderFunc, len(fields)), make([]int, len(fields))}
+	for i := range fields {
+		se.fieldEncs[i] = typeEncoder(typeByIndex(t, fields[i].index))
+		se.sorted[i] = i
+	}
+	sort.Slice(se.sorted, func(i, j int) bool {
+		return fields[se.sorted[i]].name < fields[se.sorted[j]].name
+	})
+
+	registryMu.RLock()
+	sig, ok := typeSigs[t]
+	registryMu.RUnlock()
+	if ok {
+		return func(e *Encoder, rv reflect.Value) error {
+			return se.encodeStructure(e, rv, sig)
 		}
-		if _, err = e.wr.Write(packedUint32Size(uint32(n))); err != nil {
-			return
+	}
+	if t.Implements(signerType) || reflect.PtrTo(t).Implements(signerType) {
+		return func(e *Encoder, rv reflect.Value) error {
+			sig, _ := signatureOf(rv)
+			return se.encodeStructure(e, rv, sig)
 		}
 	}
-	_, err = e.wr.Write(p)
-	return
+	return se.encodeMap
+}
+
+func (e *Encoder) marshalString(rv reflect.Value) error {
+	return e.WriteString(rv.String())
+}
+
+func (e *Encoder) marshalByteSlice(rv reflect.Value) error {
+	return e.WriteBytes(rv.Bytes())
 }
 
 func (e *Encoder) marshalStruct(rv reflect.Value) (err error) {
 	sig := byte(rv.FieldByName("Signature").Uint())
 	fields := rv.FieldByName("Fields")
 	n := fields.Len()
-	switch {
-	default:
-		return ErrMarshalValueTooLarge
-	case n < maxInt4:
-		if _, err = e.wr.Write(tinyStructSizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint8:
-		if _, err = e.wr.Write([]byte{mStructSize8}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint8Sizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint16:
-		if _, err = e.wr.Write([]byte{mStructSize16}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint16Sizes[n]); err != nil {
-			return
-		}
+	if err = e.WriteStructHeader(n, sig); err != nil {
+		return
 	}
-	e.wr.Write([]byte{sig})
 
 	for i := 0; i < n; i++ {
 		if err = e.marshal(fields.Index(i)); err != nil {
@@ -228,49 +375,167 @@ func (e *Encoder) marshalStruct(rv reflect.Value) (err error) {
 	return
 }
 
-func (e *Encoder) marshalMap(rv reflect.Value) (err error) {
-	n := rv.Len()
-	switch {
-	default:
-		return ErrMarshalValueTooLarge
-	case n < maxInt4:
-		if _, err = e.wr.Write(tinyMapSizes[n]); err != nil {
+// structEncoder encodes Go structs, whose fields are encoded by fieldEncs. sorted holds the indexes of the fields in
+// the order of their names.
+type structEncoder struct {
+	fields    []field
+	fieldEncs []encoderFunc
+	sorted    []int
+}
+
+// encodeStructure encodes a Go struct as a packstream structure, whose fields are the struct fields.
+func (se structEncoder) encodeStructure(e *Encoder, rv reflect.Value, sig byte) (err error) {
+	if err = e.WriteStructHeader(len(se.fields), sig); err != nil {
+		return
+	}
+
+	for i := range se.fields {
+		fv := fieldByIndex(rv, se.fields[i].index, false)
+		if !fv.IsValid() {
+			err = e.marshalNull()
+		} else {
+			err = se.fieldEncs[i](e, fv)
+		}
+		if err != nil {
 			return
 		}
-	case n <= math.MaxUint8:
-		if _, err = e.wr.Write([]byte{mMapSize8}); err != nil {
+	}
+	return
+}
+
+// encodeMap encodes a Go struct as a packstream map, whose keys are the struct field names.
+func (se structEncoder) encodeMap(e *Encoder, rv reflect.Value) (err error) {
+	n := 0
+	for i := range se.fields {
+		if fv := fieldByIndex(rv, se.fields[i].index, false); isEncodedField(&se.fields[i], fv) {
+			n++
+		}
+	}
+
+	if err = e.WriteMapHeader(n); err != nil {
+		return
+	}
+	for i := range se.fields {
+		if e.sortKeys {
+			i = se.sorted[i]
+		}
+		fv := fieldByIndex(rv, se.fields[i].index, false)
+		if !isEncodedField(&se.fields[i], fv) {
+			continue
+		}
+		if err = e.WriteString(se.fields[i].name); err != nil {
 			return
 		}
-		if _, err = e.wr.Write(packedUint8Sizes[n]); err != nil {
+		if err = se.fieldEncs[i](e, fv); err != nil {
 			return
 		}
-	case n <= math.MaxUint16:
-		if _, err = e.wr.Write([]byte{mMapSize16}); err != nil {
+	}
+	return
+}
+
+// mapEncoder encodes maps, whose values are encoded by elemEnc. Their keys are encoded as strings.
+type mapEncoder struct {
+	elemEnc encoderFunc
+}
+
+func (me mapEncoder) encode(e *Encoder, rv reflect.Value) (err error) {
+	if rv.IsNil() {
+		return e.marshalNull()
+	}
+	if e.sortKeys {
+		return me.encodeSorted(e, rv)
+	}
+	if err = e.WriteMapHeader(rv.Len()); err != nil {
+		return
+	}
+	var (
+		iter reflect.MapIter
+		key  string
+	)
+	iter.Reset(rv)
+	k := reflect.New(rv.Type().Key()).Elem()
+	v := reflect.New(rv.Type().Elem()).Elem()
+	for iter.Next() {
+		k.SetIterKey(&iter)
+		v.SetIterValue(&iter)
+		if key, err = mapKey(k); err != nil {
 			return
 		}
-		if _, err = e.wr.Write(packedUint16Sizes[n]); err != nil {
+		if err = e.WriteString(key); err != nil {
 			return
 		}
-	case n <= math.MaxUint32:
-		if _, err = e.wr.Write([]byte{mMapSize32}); err != nil {
+		if err = me.elemEnc(e, v); err != nil {
 			return
 		}
-		if _, err = e.wr.Write(packedUint32Size(uint32(n))); err != nil {
+	}
+	return
+}
+
+// encodeSorted encodes the entries of the map rv in the order of their keys.
+func (me mapEncoder) encodeSorted(e *Encoder, rv reflect.Value) (err error) {
+	type entry struct {
+		key string
+		k   reflect.Value
+	}
+	keys := rv.MapKeys()
+	entries := make([]entry, len(keys))
+	for i, k := range keys {
+		if entries[i].key, err = mapKey(k); err != nil {
 			return
 		}
+		entries[i].k = k
 	}
-	for _, k := range rv.MapKeys() {
-		if err = e.marshal(k); err != nil {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	if err = e.WriteMapHeader(len(entries)); err != nil {
+		return
+	}
+	// As when iterating, the values are encoded from an addressable copy, so that the pointer methods of their
+	// type apply.
+	v := reflect.New(rv.Type().Elem()).Elem()
+	for i := range entries {
+		if err = e.WriteString(entries[i].key); err != nil {
 			return
 		}
-		if err = e.marshal(rv.MapIndex(k)); err != nil {
+		v.Set(rv.MapIndex(entries[i].k))
+		if err = me.elemEnc(e, v); err != nil {
 			return
 		}
 	}
 	return
 }
 
-func (e *Encoder) marshalInt(rv reflect.Value) (err error) {
+// mapKey returns the string encoding the map key k, which is either a string, an integer formatted in decimal, or
+// the text of an encoding.TextMarshaler, as in encoding/json.
+func mapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		p, err := tm.MarshalText()
+		if err != nil {
+			return "", &MarshalerError{Type: k.Type(), Err: err, sourceFunc: "MarshalText"}
+		}
+		return string(p), nil
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	panic("unexpected map key type")
+}
+
+// isEncodedField reports whether the value fv of the struct field f is encoded as a map entry.
+func isEncodedField(f *field, fv reflect.Value) bool {
+	return fv.IsValid() && !(f.omitEmpty && isEmptyValue(fv))
+}
+
+func (e *Encoder) marshalInt(rv reflect.Value) error {
 	var n int64
 	switch rv.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
@@ -282,126 +547,101 @@ func (e *Encoder) marshalInt(rv reflect.Value) (err error) {
 		}
 		n = int64(un)
 	}
+	return e.WriteInt(n)
+}
 
-	switch {
-	case minTinyInt <= n && n <= math.MaxInt8:
-		if _, err = e.wr.Write([]byte{byte(n)}); err != nil {
-			return
-		}
-		return
-	case math.MinInt8 <= n && n < minTinyInt:
-		if _, err = e.wr.Write([]byte{mInt8}); err != nil {
-			return
-		}
-		if err = binary.Write(e.wr, binary.BigEndian, int8(n)); err != nil {
-			return
-		}
+func (e *Encoder) marshalFloat(rv reflect.Value) error {
+	return e.WriteFloat(rv.Float())
+}
 
-	case math.MinInt16 <= n && n <= math.MaxInt16:
-		if _, err = e.wr.Write([]byte{mInt16}); err != nil {
-			return
-		}
-		if err = binary.Write(e.wr, binary.BigEndian, int16(n)); err != nil {
-			return
-		}
-	case math.MinInt32 <= n && n <= math.MaxInt32:
-		if _, err = e.wr.Write([]byte{mInt32}); err != nil {
-			return
-		}
-		if err = binary.Write(e.wr, binary.BigEndian, int32(n)); err != nil {
-			return
-		}
-	case math.MinInt64 <= n && n <= math.MaxInt64:
-		if _, err = e.wr.Write([]byte{mInt64}); err != nil {
-			return
-		}
-		if err = binary.Write(e.wr, binary.BigEndian, n); err != nil {
-			return
-		}
-	}
-	return
+func (e *Encoder) marshalBool(rv reflect.Value) error {
+	return e.WriteBool(rv.Bool())
+}
+
+func (e *Encoder) marshalNull() error {
+	return e.WriteNull()
 }
 
-func (e *Encoder) marshalFloat(rv reflect.Value) (err error) {
-	var p [8]byte
-	n := rv.Float()
-	if _, err = e.wr.Write([]byte{mFloat64}); err != nil {
+// listEncoder encodes slices, whose elements are encoded by elemEnc.
+type listEncoder struct {
+	elemEnc encoderFunc
+}
+
+func (le listEncoder) encode(e *Encoder, rv reflect.Value) (err error) {
+	if rv.IsNil() {
+		return e.marshalNull()
+	}
+	n := rv.Len()
+	if err = e.WriteListHeader(n); err != nil {
 		return
 	}
-	bits := math.Float64bits(n)
-	binary.BigEndian.PutUint64(p[:], bits)
-	_, err = e.wr.Write(p[:])
-	return
-}
 
-func (e *Encoder) marshalBool(rv reflect.Value) (err error) {
-	v := rv.Bool()
-	if v {
-		_, err = e.wr.Write([]byte{mTrue})
-	} else {
-		_, err = e.wr.Write([]byte{mFalse})
+	for i := 0; i < n; i++ {
+		if err = le.elemEnc(e, rv.Index(i)); err != nil {
+			return
+		}
 	}
 	return
 }
 
-func (e *Encoder) marshalNull() (err error) {
-	_, err = e.wr.Write([]byte{mNull})
-	return
+// chanEncoder encodes the values received from a channel as a streamed list, until the channel is closed. The
+// values are encoded by elemEnc.
+type chanEncoder struct {
+	elemEnc encoderFunc
 }
 
-func (e *Encoder) marshalList(rv reflect.Value) (err error) {
-	n := rv.Len()
-	switch {
-	default:
-		return ErrMarshalValueTooLarge
-	case n < maxInt4:
-		if _, err = e.wr.Write(tinyListSizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint8:
-		if _, err = e.wr.Write([]byte{mListSize8}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint8Sizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint16:
-		if _, err = e.wr.Write([]byte{mListSize16}); err != nil {
-			return
-		}
-		if _, err = e.wr.Write(packedUint16Sizes[n]); err != nil {
-			return
-		}
-	case n <= math.MaxUint32:
-		if _, err = e.wr.Write([]byte{mListSize32}); err != nil {
-			return
+func (ce chanEncoder) encode(e *Encoder, rv reflect.Value) (err error) {
+	if rv.IsNil() {
+		return e.marshalNull()
+	}
+	if err = e.BeginList(); err != nil {
+		return
+	}
+	for {
+		v, ok := rv.Recv()
+		if !ok {
+			break
 		}
-		if _, err = e.wr.Write(packedUint32Size(uint32(n))); err != nil {
+		if err = ce.elemEnc(e, v); err != nil {
 			return
 		}
-	}
-
-	for i := 0; i < n; i++ {
-		if err = e.marshal(rv.Index(i)); err != nil {
-			return
+		// Stream the elements as they are received.
+		if !e.buffered {
+			if err = e.Flush(); err != nil {
+				return
+			}
 		}
 	}
-	return
+	return e.End()
 }
 
 func (e *Encoder) marshalMarshaler(v Marshaler) (err error) {
 	var p []byte
 	if p, err = v.MarshalPS(); err == nil {
-		_, err = e.wr.Write(p)
-		return nil
+		return e.write(p)
 	}
-	return
+	return &MarshalerError{Type: reflect.TypeOf(v), Err: err}
+}
+
+func (e *Encoder) marshalStreamMarshaler(v StreamMarshaler) error {
+	if err := v.EncodePS(e); err != nil {
+		return &MarshalerError{Type: reflect.TypeOf(v), Err: err, sourceFunc: "EncodePS"}
+	}
+	return nil
 }
 
 func (e *Encoder) marshalTime(rv reflect.Value) error {
 	tm := rv.Interface().(time.Time)
+	switch e.timeFormat {
+	case TimeISO8601:
+		return e.WriteString(tm.Format(time.RFC3339Nano))
+	case TimeStructure:
+		return e.marshalMarshaler(DateTime{tm})
+	}
 	if tm.IsZero() {
-		return e.Encode(0)
+		return e.WriteInt(0)
+	} else if e.timeFormat == TimeUnixMilli {
+		return e.WriteInt(tm.UnixMilli())
 	}
-	return e.Encode(tm.UnixNano())
+	return e.WriteInt(tm.UnixNano())
 }
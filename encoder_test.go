@@ -2,8 +2,11 @@ package packstream
 
 import (
 	"bytes"
+	"errors"
 	"math"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -37,6 +40,93 @@ func TestEncoder_Encode(t *testing.T) {
 	}
 }
 
+type testCountingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *testCountingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestEncoder_Flush(t *testing.T) {
+	var w testCountingWriter
+	v := map[string]interface{}{"list": []interface{}{"a", int64(1000), 1.5, nil}}
+	encoded, _ := Marshal(v)
+
+	enc := NewEncoder(&w)
+	if err := enc.Encode(v); err != nil {
+		t.Error(err)
+	} else if w.writes != 1 || !bytes.Equal(w.Bytes(), encoded) {
+		t.Errorf("a value should be written at once, got %v writes of % #X", w.writes, w.Bytes())
+	}
+
+	w = testCountingWriter{}
+	enc = NewBufferedEncoder(&w, 0)
+	enc.Encode(v)
+	enc.WriteString("a")
+	if w.writes != 0 {
+		t.Errorf("a buffered encoder should not write before Flush, got %v writes", w.writes)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Error(err)
+	} else if w.writes != 1 || !bytes.Equal(w.Bytes(), append(encoded, 0x81, 0x61)) {
+		t.Errorf("invalid flushed bytes, got %v writes of % #X", w.writes, w.Bytes())
+	}
+
+	w = testCountingWriter{}
+	enc = NewBufferedEncoder(&w, 4)
+	enc.Encode("abcdef")
+	enc.Encode("a")
+	if w.writes != 1 || w.Len() != 7 {
+		t.Errorf("a buffered encoder should write once its threshold is reached, got %v writes of % #X", w.writes, w.Bytes())
+	}
+}
+
+func TestEncoder_Encode_Error(t *testing.T) {
+	// The partial encoding of a value which fails is not written with the next values.
+	for _, buffered := range []bool{false, true} {
+		var (
+			w   bytes.Buffer
+			enc *Encoder
+		)
+		if buffered {
+			enc = NewBufferedEncoder(&w, 0)
+		} else {
+			enc = NewEncoder(&w)
+		}
+		enc.Encode(1)
+		if err := enc.Encode([]interface{}{1, 2, testFailingMarshaler{}}); err == nil {
+			t.Error("error should not be nil when a list element fails.")
+		}
+		enc.Encode(3)
+		enc.Flush()
+		if res := []byte{0x01, 0x03}; !bytes.Equal(w.Bytes(), res) {
+			t.Errorf("invalid written bytes, got % #X, expected % #X", w.Bytes(), res)
+		}
+	}
+
+	// A channel is streamed as its values are received: only the buffered part of a failure is discarded. The
+	// streamed list left open is not kept.
+	var w bytes.Buffer
+	enc := NewEncoder(&w)
+	ch := make(chan interface{}, 2)
+	ch <- 1
+	ch <- testFailingMarshaler{}
+	close(ch)
+	if err := enc.Encode(ch); err == nil {
+		t.Error("error should not be nil when a channel element fails.")
+	}
+	if err := enc.End(); err != ErrNoStream {
+		t.Errorf("error should be ErrNoStream, got %v", err)
+	}
+	enc.Encode(3)
+	if res := []byte{mListSizeStream, 0x01, 0x03}; !bytes.Equal(w.Bytes(), res) {
+		t.Errorf("invalid written bytes, got % #X, expected % #X", w.Bytes(), res)
+	}
+}
+
 func TestMarshal(t *testing.T) {
 	for _, val := range validTestValues {
 		if b, err := Marshal(val.Decoded); err != nil {
@@ -240,6 +330,28 @@ func TestMarshal_Marshaler(t *testing.T) {
 	}
 }
 
+func TestMarshal_StreamMarshaler(t *testing.T) {
+	v := []interface{}{testPair{"a", []int64{1, 2}}, &testPair{Name: "b"}, (*testPair)(nil)}
+	res := []byte{0x93, 0x92, 0x81, 'a', 0x92, 0x01, 0x02, 0x92, 0x81, 'b', mNull, mNull}
+	if b, err := Marshal(v); err != nil {
+		t.Errorf("error while encoding stream marshalers: %v", err)
+	} else if !bytes.Equal(res, b) {
+		t.Errorf("error while encoding stream marshalers got % #X, expected % #X", b, res)
+	}
+	if b, err := AppendMarshal([]byte{0x01}, v); err != nil {
+		t.Errorf("error while appending stream marshalers: %v", err)
+	} else if !bytes.Equal(append([]byte{0x01}, res...), b) {
+		t.Errorf("error while appending stream marshalers got % #X", b)
+	}
+
+	var w testCountingWriter
+	if err := NewEncoder(&w).Encode(v); err != nil {
+		t.Error(err)
+	} else if w.writes != 1 || !bytes.Equal(w.Bytes(), res) {
+		t.Errorf("a stream marshaler should be written at once, got %v writes of % #X", w.writes, w.Bytes())
+	}
+}
+
 func TestEncoder_Encode_Time(t *testing.T) {
 	var b bytes.Buffer
 	enc := NewEncoder(&b)
@@ -262,3 +374,344 @@ func TestEncoder_Encode_Time(t *testing.T) {
 	}
 	b.Reset()
 }
+
+func TestEncoder_SetTimeFormat(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	tm := time.Date(2016, time.January, 02, 12, 42, 43, 5e6, time.FixedZone("", 3600))
+
+	tests := []struct {
+		format  TimeFormat
+		encoded []byte
+	}{
+		{TimeUnixMilli, []byte{mInt64, 0x00, 0x00, 0x01, 0x52, 0x02, 0x25, 0x93, 0x3D}},
+		{TimeISO8601, append([]byte{mStringSize8, 0x1D}, "2016-01-02T12:42:43.005+01:00"...)},
+		{TimeStructure, []byte{0xB3, SigDateTime, mInt32, 0x56, 0x87, 0xC5, 0xC3, mInt32, 0x00, 0x4C, 0x4B, 0x40, mInt16, 0x0E, 0x10}},
+	}
+	for _, test := range tests {
+		b.Reset()
+		enc.SetTimeFormat(test.format)
+		if err := enc.Encode(tm); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(b.Bytes(), test.encoded) {
+			t.Errorf("format %v: got % #X, expected % #X", test.format, b.Bytes(), test.encoded)
+		}
+	}
+}
+
+type Inner struct {
+	Embedded string
+	Name     string
+}
+
+type testStruct struct {
+	Inner
+	Name    string
+	Count   int64  `packstream:"count,omitempty"`
+	Skipped string `packstream:"-"`
+	private string
+}
+
+func TestMarshal_Struct(t *testing.T) {
+	var m map[string]interface{}
+
+	v := testStruct{Inner: Inner{Embedded: "e", Name: "hidden"}, Name: "n", Skipped: "s", private: "p"}
+	if b, err := Marshal(v); err != nil {
+		t.Errorf("error while encoding struct: %v", err)
+	} else if b[0] != tinyMapSizes[2][0] {
+		t.Errorf("error while encoding struct: invalid marker, got %#X, expected %#X", b[0], tinyMapSizes[2][0])
+	} else if err := Unmarshal(b, &m); err != nil {
+		t.Errorf("error while decoding encoded struct: %v", err)
+	} else if !reflect.DeepEqual(m, map[string]interface{}{"Embedded": "e", "Name": "n"}) {
+		t.Errorf("invalid encoded struct, got %v", m)
+	}
+
+	v.Count = 42
+	if b, err := Marshal(&v); err != nil {
+		t.Errorf("error while encoding struct: %v", err)
+	} else if b[0] != tinyMapSizes[3][0] {
+		t.Errorf("error while encoding struct: invalid marker, got %#X, expected %#X", b[0], tinyMapSizes[3][0])
+	}
+}
+
+type testPointers struct {
+	A *int
+	B *string
+	C *Inner
+	N *Node
+	T *time.Time
+}
+
+func TestMarshal_PointerFields(t *testing.T) {
+	a, b, tm := 5, "hi", time.Unix(0, 42)
+	v := testPointers{&a, &b, &Inner{Embedded: "e"}, &Node{ID: 1}, &tm}
+	expected := map[string]interface{}{
+		"A": int64(5),
+		"B": "hi",
+		"C": map[string]interface{}{"Embedded": "e", "Name": ""},
+		"N": Node{ID: 1},
+		"T": int64(42),
+	}
+
+	var m map[string]interface{}
+	if p, err := Marshal(v); err != nil {
+		t.Error(err)
+	} else if err := Unmarshal(p, &m); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(m, expected) {
+		t.Errorf("invalid encoded pointer fields, got %#v", m)
+	}
+
+	m = nil
+	if p, err := Marshal(testPointers{}); err != nil {
+		t.Error(err)
+	} else if err := Unmarshal(p, &m); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(m, map[string]interface{}{"A": nil, "B": nil, "C": nil, "N": nil, "T": nil}) {
+		t.Errorf("nil pointer fields should be encoded as null, got %#v", m)
+	}
+
+	var d testPointers
+	if p, err := Marshal(v); err != nil {
+		t.Error(err)
+	} else if err := Unmarshal(p, &d); err != nil {
+		t.Error(err)
+	} else if *d.A != a || *d.B != b || *d.C != *v.C || !reflect.DeepEqual(d.N, v.N) || !d.T.Equal(tm) {
+		t.Errorf("invalid decoded pointer fields, got %+v", d)
+	}
+}
+
+func TestEncoder_BeginList(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+
+	res := []byte{mListSizeStream, 0x01, mMapSizeStream, 0x81, 0x61, 0x02, mEndOfStream, mEndOfStream}
+	if err := enc.BeginList(); err != nil {
+		t.Error(err)
+	} else if err := enc.Encode(1); err != nil {
+		t.Error(err)
+	} else if err := enc.BeginMap(); err != nil {
+		t.Error(err)
+	} else if err := enc.Encode("a"); err != nil {
+		t.Error(err)
+	} else if err := enc.Encode(2); err != nil {
+		t.Error(err)
+	} else if err := enc.End(); err != nil {
+		t.Error(err)
+	} else if err := enc.End(); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b.Bytes(), res) {
+		t.Errorf("invalid streamed list, got % #X, expected % #X", b.Bytes(), res)
+	}
+
+	if err := enc.End(); err != ErrNoStream {
+		t.Errorf("ending a stream which has not been started should fail, got %v", err)
+	}
+
+	var v []interface{}
+	if err := Unmarshal(res, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, []interface{}{int64(1), map[string]interface{}{"a": int64(2)}}) {
+		t.Errorf("invalid decoded streamed list, got %v", v)
+	}
+}
+
+func TestMarshal_Chan(t *testing.T) {
+	c := make(chan int, 3)
+	c <- 1
+	c <- 2
+	close(c)
+
+	res := []byte{mListSizeStream, 0x01, 0x02, mEndOfStream}
+	if b, err := Marshal(c); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, res) {
+		t.Errorf("invalid encoded channel, got % #X, expected % #X", b, res)
+	}
+
+	if _, err := Marshal(make(chan<- int)); !errors.Is(err, ErrMarshalTypeError) {
+		t.Errorf("encoding a send-only channel should fail, got %v", err)
+	}
+
+	var v struct{ C chan int }
+	if b, err := Marshal(v); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, []byte{0xA1, 0x81, 'C', mNull}) {
+		t.Errorf("a nil channel should be encoded as null, got % #X", b)
+	}
+}
+
+// testTextKey is a map key encoded as text.
+type testTextKey struct {
+	A, B int
+}
+
+func (k testTextKey) MarshalText() ([]byte, error) {
+	if k.A < 0 {
+		return nil, errors.New("negative key")
+	}
+	return []byte(strconv.Itoa(k.A) + "-" + strconv.Itoa(k.B)), nil
+}
+
+func (k *testTextKey) UnmarshalText(p []byte) (err error) {
+	a, b, ok := strings.Cut(string(p), "-")
+	if !ok {
+		return errors.New("invalid key")
+	}
+	if k.A, err = strconv.Atoi(a); err == nil {
+		k.B, err = strconv.Atoi(b)
+	}
+	return
+}
+
+func TestMarshal_MapKeys(t *testing.T) {
+	for _, tc := range []struct {
+		v   interface{}
+		res []byte
+	}{
+		{map[int64]bool{-1: true}, []byte{0xA1, 0x82, '-', '1', mTrue}},
+		{map[uint8]bool{255: true}, []byte{0xA1, 0x83, '2', '5', '5', mTrue}},
+		{map[testTextKey]bool{{1, 2}: true}, []byte{0xA1, 0x83, '1', '-', '2', mTrue}},
+		{map[*testTextKey]bool{nil: true}, []byte{0xA1, 0x80, mTrue}},
+	} {
+		if b, err := Marshal(tc.v); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(b, tc.res) {
+			t.Errorf("invalid encoded map %v, got % #X, expected % #X", tc.v, b, tc.res)
+		}
+	}
+
+	var mErr *MarshalerError
+	if _, err := Marshal(map[testTextKey]bool{{-1, 0}: true}); !errors.As(err, &mErr) {
+		t.Errorf("a failing MarshalText should return a MarshalerError, got %v", err)
+	} else if !strings.Contains(err.Error(), "MarshalText") {
+		t.Errorf("invalid error message, got %v", err)
+	}
+}
+
+func TestMarshalCanonical(t *testing.T) {
+	type testFields struct {
+		B int
+		A int `packstream:"c"`
+	}
+	v := map[string]interface{}{
+		"b": testFields{1, 2},
+		"a": []interface{}{map[int]int{10: 1, 9: 2}},
+	}
+	res := []byte{0xA2,
+		0x81, 'a', 0x91, 0xA2, 0x82, '1', '0', 0x01, 0x81, '9', 0x02,
+		0x81, 'b', 0xA2, 0x81, 'B', 0x01, 0x81, 'c', 0x02,
+	}
+	if b, err := MarshalCanonical(v); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, res) {
+		t.Errorf("invalid canonical encoding, got % #X, expected % #X", b, res)
+	}
+
+	// Map values are encoded as by Marshal, including those whose Marshaler has a pointer receiver.
+	pm := map[string]marshaller{"a": 1}
+	if b, err := MarshalCanonical(pm); err != nil {
+		t.Error(err)
+	} else if expected, _ := Marshal(pm); !bytes.Equal(b, expected) {
+		t.Errorf("invalid canonical encoding, got % #X, expected % #X", b, expected)
+	}
+
+	// The pooled encoders of Marshal do not keep sorting the keys.
+	if b, err := Marshal(testFields{1, 2}); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, []byte{0xA2, 0x81, 'B', 0x01, 0x81, 'c', 0x02}) {
+		t.Errorf("invalid encoded struct, got % #X", b)
+	}
+}
+
+func TestEncoder_SetSortMapKeys(t *testing.T) {
+	m := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		m[strconv.Itoa(i)] = i
+	}
+
+	var first []byte
+	for i := 0; i < 10; i++ {
+		var b bytes.Buffer
+		enc := NewEncoder(&b)
+		enc.SetSortMapKeys(true)
+		if err := enc.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = b.Bytes()
+		} else if !bytes.Equal(b.Bytes(), first) {
+			t.Fatal("the encoding of a map with sorted keys should be deterministic")
+		}
+	}
+
+	var v map[string]int
+	if err := Unmarshal(first, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, m) {
+		t.Errorf("invalid decoded map, got %v", v)
+	}
+}
+
+type testTree struct {
+	Value    int64
+	Children []*testTree `packstream:",omitempty"`
+}
+
+func TestMarshal_RecursiveType(t *testing.T) {
+	v := &testTree{Value: 1, Children: []*testTree{{Value: 2}, nil}}
+	res := []byte{0xA2, 0x85, 'V', 'a', 'l', 'u', 'e', 0x01, 0x88, 'C', 'h', 'i', 'l', 'd', 'r', 'e', 'n', 0x92,
+		0xA1, 0x85, 'V', 'a', 'l', 'u', 'e', 0x02, mNull}
+	if b, err := Marshal(v); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, res) {
+		t.Errorf("invalid encoded recursive struct, got % #X, expected % #X", b, res)
+	}
+}
+
+type benchItem struct {
+	Name  string
+	Score float64
+	Tags  []string
+	Valid bool `packstream:"valid,omitempty"`
+}
+
+// benchListOfMaps returns a list of maps, as the records of a query result.
+func benchListOfMaps() []map[string]interface{} {
+	l := make([]map[string]interface{}, 100)
+	for i := range l {
+		l[i] = map[string]interface{}{"id": int64(i), "name": "packstream", "score": 0.5, "tags": []interface{}{"a", "b"}}
+	}
+	return l
+}
+
+// benchStructures returns a list of structures: nodes, and structs encoded as maps.
+func benchStructures() ([]Node, []benchItem) {
+	nodes, items := make([]Node, 100), make([]benchItem, 100)
+	for i := range nodes {
+		nodes[i] = Node{ID: int64(i), Labels: []string{"Person"}, Properties: map[string]interface{}{"name": "packstream"}}
+		items[i] = benchItem{Name: "packstream", Score: 0.5, Tags: []string{"a", "b"}, Valid: true}
+	}
+	return nodes, items
+}
+
+func BenchmarkMarshal_ListOfMaps(b *testing.B) {
+	l := benchListOfMaps()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(l); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshal_Structures(b *testing.B) {
+	nodes, items := benchStructures()
+	v := []interface{}{nodes, items}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
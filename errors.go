@@ -0,0 +1,111 @@
+package packstream
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// UnmarshalTypeError describes a packstream value which is not appropriate for the Go value it is decoded into.
+// It matches ErrUnMarshalTypeError with errors.Is.
+type UnmarshalTypeError struct {
+	Marker byte         // Marker is the marker of the packstream value.
+	GoType reflect.Type // GoType is the type of the Go value.
+	Offset int64        // Offset is the offset of the packstream value in the input.
+	Path   string       // Path is the path of the value from the decoded value, such as "items[2].name".
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	msg := "packstream: cannot unmarshal " + markerKind(e.Marker).String() + " into Go value of type " +
+		fmt.Sprint(e.GoType) + " at offset " + strconv.FormatInt(e.Offset, 10)
+	if e.Path != "" {
+		msg += " (" + e.Path + ")"
+	}
+	return msg
+}
+
+// Unwrap returns ErrUnMarshalTypeError.
+func (e *UnmarshalTypeError) Unwrap() error {
+	return ErrUnMarshalTypeError
+}
+
+// UnsupportedTypeError describes a Go value which cannot be encoded. It matches ErrMarshalTypeError with errors.Is.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "packstream: unsupported type: " + e.Type.String()
+}
+
+// Unwrap returns ErrMarshalTypeError.
+func (e *UnsupportedTypeError) Unwrap() error {
+	return ErrMarshalTypeError
+}
+
+// MarshalerError describes an error returned by the MarshalPS method of a Marshaler, the EncodePS method of a
+// StreamMarshaler, or the MarshalText method of a map key.
+type MarshalerError struct {
+	Type       reflect.Type
+	Err        error
+	sourceFunc string
+}
+
+func (e *MarshalerError) Error() string {
+	srcFunc := e.sourceFunc
+	if srcFunc == "" {
+		srcFunc = "MarshalPS"
+	}
+	return "packstream: error calling " + srcFunc + " for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error returned by the method.
+func (e *MarshalerError) Unwrap() error {
+	return e.Err
+}
+
+// pathElem is an element of the path of the value being decoded: a list index, or a map key or struct field name
+// when index is -1.
+type pathElem struct {
+	key   string
+	index int
+}
+
+// pushIndex appends the list index i to the path of the value being decoded.
+func (d *decodeState) pushIndex(i int) {
+	d.path = append(d.path, pathElem{index: i})
+}
+
+// pushKey appends the map key or field name k to the path of the value being decoded.
+func (d *decodeState) pushKey(k string) {
+	d.path = append(d.path, pathElem{key: k, index: -1})
+}
+
+// pop removes the last element of the path of the value being decoded.
+func (d *decodeState) pop() {
+	d.path = d.path[:len(d.path)-1]
+}
+
+// typeError returns an UnmarshalTypeError for the value of marker m starting at offset, decoded into rv.
+func (d *decodeState) typeError(m byte, rv reflect.Value, offset uint64) error {
+	var b strings.Builder
+	for _, e := range d.path {
+		if e.index >= 0 {
+			b.WriteByte('[')
+			b.WriteString(strconv.Itoa(e.index))
+			b.WriteByte(']')
+		} else {
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(e.key)
+		}
+	}
+
+	t := rv.Type()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return &UnmarshalTypeError{Marker: m, GoType: t, Offset: int64(offset), Path: b.String()}
+}
@@ -0,0 +1,96 @@
+package packstream
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testErrorRecord struct {
+	Items []int64 `packstream:"items"`
+}
+
+type testFailingMarshaler struct{}
+
+var errTestMarshaler = errors.New("failing marshaler")
+
+func (testFailingMarshaler) MarshalPS() ([]byte, error) {
+	return nil, errTestMarshaler
+}
+
+type testFailingStreamMarshaler struct{}
+
+func (testFailingStreamMarshaler) EncodePS(e *Encoder) error {
+	if err := e.WriteListHeader(1); err != nil {
+		return err
+	}
+	return e.Encode(testFailingMarshaler{})
+}
+
+type testFailingWriter struct{}
+
+func (testFailingWriter) Write([]byte) (int, error) {
+	return 0, errTestMarshaler
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	encoded := []byte{0x92, 0xA0, 0xA1, 0x85, 0x69, 0x74, 0x65, 0x6D, 0x73, 0x92, 0x01, 0x81, 0x78}
+	expected := &UnmarshalTypeError{Marker: 0x81, GoType: reflect.TypeOf(int64(0)), Offset: 11, Path: "[1].items[1]"}
+
+	var v []testErrorRecord
+	err := Unmarshal(encoded, &v)
+	if !errors.Is(err, ErrUnMarshalTypeError) {
+		t.Errorf("error should match ErrUnMarshalTypeError, got %v", err)
+	}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("invalid error, got %#v, expected %#v", err, expected)
+	}
+
+	dec := NewDecoder(bytes.NewReader(append([]byte{0x2A}, encoded...)))
+	var i int64
+	dec.Decode(&i)
+	expected.Offset++
+	if err := dec.Decode(&v); !reflect.DeepEqual(err, expected) {
+		t.Errorf("invalid error, got %#v, expected %#v", err, expected)
+	} else if msg := err.Error(); msg != "packstream: cannot unmarshal string into Go value of type int64 at offset 12 ([1].items[1])" {
+		t.Errorf("invalid error message, got %v", msg)
+	}
+
+	var s string
+	err = Unmarshal([]byte{0x2A}, &s)
+	if e, ok := err.(*UnmarshalTypeError); !ok || e.Offset != 0 || e.Path != "" || e.GoType != reflect.TypeOf(s) {
+		t.Errorf("invalid error, got %#v", err)
+	}
+}
+
+func TestMarshal_Errors(t *testing.T) {
+	_, err := Marshal(map[float64]string{})
+	if e, ok := err.(*UnsupportedTypeError); !ok || e.Type != reflect.TypeOf(map[float64]string{}) {
+		t.Errorf("invalid error, got %#v", err)
+	} else if !errors.Is(err, ErrMarshalTypeError) {
+		t.Errorf("error should match ErrMarshalTypeError, got %v", err)
+	}
+
+	_, err = Marshal([]interface{}{testFailingMarshaler{}})
+	if e, ok := err.(*MarshalerError); !ok || e.Type != reflect.TypeOf(testFailingMarshaler{}) {
+		t.Errorf("invalid error, got %#v", err)
+	} else if !errors.Is(err, errTestMarshaler) {
+		t.Errorf("error should match the marshaler error, got %v", err)
+	}
+
+	_, err = Marshal(testFailingStreamMarshaler{})
+	if e, ok := err.(*MarshalerError); !ok || e.Type != reflect.TypeOf(testFailingStreamMarshaler{}) {
+		t.Errorf("invalid error, got %#v", err)
+	} else if !errors.Is(err, errTestMarshaler) {
+		t.Errorf("error should match the nested marshaler error, got %v", err)
+	} else if msg := err.Error(); msg != "packstream: error calling EncodePS for type packstream.testFailingStreamMarshaler: "+
+		"packstream: error calling MarshalPS for type packstream.testFailingMarshaler: failing marshaler" {
+		t.Errorf("invalid error message, got %v", msg)
+	}
+
+	m := marshaller(0)
+	if err := NewBufferedEncoder(testFailingWriter{}, 1).Encode(&m); err != errTestMarshaler {
+		t.Errorf("the write error of a marshaler should be returned, got %v", err)
+	}
+}
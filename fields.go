@@ -0,0 +1,280 @@
+package packstream
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field represents a Go struct field encoded as a packstream map entry.
+type field struct {
+	name      string
+	tagged    bool
+	index     []int
+	typ       reflect.Type
+	omitEmpty bool
+}
+
+// structFields holds the encoded fields of a Go struct type, and an index to find them by name.
+type structFields struct {
+	list   []field
+	byName map[string]int
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+// cachedTypeFields is like typeFields but uses a cache to avoid repeated work.
+func cachedTypeFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.(*structFields)
+}
+
+// lookup returns the field matching the given name. An exact match is preferred, but a case-insensitive
+// match is accepted. It returns nil if no field matches.
+func (sf *structFields) lookup(name string) *field {
+	if i, ok := sf.byName[name]; ok {
+		return &sf.list[i]
+	}
+	for i := range sf.list {
+		if strings.EqualFold(sf.list[i].name, name) {
+			return &sf.list[i]
+		}
+	}
+	return nil
+}
+
+// parseTag splits a struct field's packstream tag into its name and its comma-separated options.
+func parseTag(tag string) (string, string) {
+	if i := strings.Index(tag, ","); i != -1 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+// hasOption reports whether the comma-separated options contains the given option.
+func hasOption(options, option string) bool {
+	for options != "" {
+		var o string
+		if i := strings.Index(options, ","); i != -1 {
+			o, options = options[:i], options[i+1:]
+		} else {
+			o, options = options, ""
+		}
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// typeFields returns the fields that should be recognized for the given struct type.
+//
+// It follows the same rules as encoding/json: the fields of embedded structs are promoted to the outer struct,
+// shallower fields hide deeper ones, and at the same depth a tagged field hides untagged ones. Other conflicting
+// fields are dropped.
+func typeFields(t reflect.Type) *structFields {
+	var (
+		current []field
+		next    = []field{{typ: t}}
+
+		count     map[reflect.Type]int
+		nextCount = map[reflect.Type]int{}
+
+		visited = map[reflect.Type]bool{}
+		fields  []field
+	)
+
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, map[reflect.Type]int{}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := 0; i < f.typ.NumField(); i++ {
+				sf := f.typ.Field(i)
+				if sf.Anonymous {
+					ft := sf.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					if sf.PkgPath != "" && ft.Kind() != reflect.Struct {
+						// Ignore embedded fields of unexported non-struct types.
+						continue
+					}
+				} else if sf.PkgPath != "" {
+					// Ignore unexported non-embedded fields.
+					continue
+				}
+				tag := sf.Tag.Get("packstream")
+				if tag == "-" {
+					continue
+				}
+				name, options := parseTag(tag)
+
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				// Record a named field, or an embedded struct which is not flattened.
+				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+					tagged := name != ""
+					if name == "" {
+						name = sf.Name
+					}
+					fields = append(fields, field{
+						name:      name,
+						tagged:    tagged,
+						index:     index,
+						typ:       ft,
+						omitEmpty: hasOption(options, "omitempty"),
+					})
+					if count[f.typ] > 1 {
+						// If there were multiple instances, add a second, so that the annihilation code will see
+						// a duplicate. It only cares about the distinction between 1 and 2, so don't bother
+						// generating any more copies.
+						fields = append(fields, fields[len(fields)-1])
+					}
+					continue
+				}
+
+				// Record a new anonymous struct to explore in the next round.
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, field{name: ft.Name(), index: index, typ: ft})
+				}
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		x := fields
+		if x[i].name != x[j].name {
+			return x[i].name < x[j].name
+		}
+		if len(x[i].index) != len(x[j].index) {
+			return len(x[i].index) < len(x[j].index)
+		}
+		if x[i].tagged != x[j].tagged {
+			return x[i].tagged
+		}
+		return indexLess(x[i].index, x[j].index)
+	})
+
+	// Delete all fields that are hidden by the Go rules for embedded fields, except that fields with packstream
+	// tags are promoted.
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		fi := fields[i]
+		name := fi.name
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != name {
+				break
+			}
+		}
+		if advance == 1 {
+			out = append(out, fi)
+			continue
+		}
+		if dominant, ok := dominantField(fields[i : i+advance]); ok {
+			out = append(out, dominant)
+		}
+	}
+	fields = out
+
+	sort.Slice(fields, func(i, j int) bool {
+		return indexLess(fields[i].index, fields[j].index)
+	})
+
+	byName := make(map[string]int, len(fields))
+	for i, f := range fields {
+		byName[f.name] = i
+	}
+	return &structFields{list: fields, byName: byName}
+}
+
+// indexLess reports whether the field index sequence a comes before b in declaration order.
+func indexLess(a, b []int) bool {
+	for k, xk := range a {
+		if k >= len(b) {
+			return false
+		}
+		if xk != b[k] {
+			return xk < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// dominantField looks through the fields, all of which are known to have the same name, to find the single
+// field that dominates the others using Go's embedding rules, modified by the presence of packstream tags.
+// If there are multiple top-level fields, it returns false. The fields are sorted in increasing index-length
+// order, then by presence of tag.
+func dominantField(fields []field) (field, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tagged == fields[1].tagged {
+		return field{}, false
+	}
+	return fields[0], true
+}
+
+// fieldByIndex returns the nested field of v designated by index. If alloc is true, nil embedded pointers are
+// allocated along the way, otherwise an invalid value is returned when one is encountered. An invalid value is
+// also returned if the embedded pointer cannot be allocated because its type is unexported.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// typeByIndex returns the type of the nested field of t designated by index. Unlike the typ of a field, unnamed
+// pointer types are not dereferenced.
+func typeByIndex(t reflect.Type, index []int) reflect.Type {
+	for _, i := range index {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		t = t.Field(i).Type
+	}
+	return t
+}
+
+// isEmptyValue reports whether v is considered empty by the omitempty option.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
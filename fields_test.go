@@ -0,0 +1,59 @@
+package packstream
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testConflictA struct {
+	Conflict string
+	Tagged   string
+}
+
+type testConflictB struct {
+	Conflict string
+	Tagged   string `packstream:"Tagged"`
+}
+
+type testConflict struct {
+	testConflictA
+	testConflictB
+	*Inner
+	Renamed Inner `packstream:"renamed"`
+}
+
+type testUnexportedPtr struct {
+	*testConflictA
+}
+
+func TestTypeFields(t *testing.T) {
+	fields := typeFields(reflect.TypeOf(testConflict{}))
+	names := make([]string, len(fields.list))
+	for i, f := range fields.list {
+		names[i] = f.name
+	}
+	expected := []string{"Tagged", "Embedded", "Name", "renamed"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("invalid fields, got %v, expected %v", names, expected)
+	}
+	if f := fields.lookup("tagged"); f == nil || !reflect.DeepEqual(f.index, []int{1, 1}) {
+		t.Errorf("invalid case-insensitive lookup, got %v", f)
+	}
+	if f := fields.lookup("Conflict"); f != nil {
+		t.Errorf("conflicting fields should be dropped, got %v", f)
+	}
+}
+
+func TestUnmarshal_EmbeddedPointer(t *testing.T) {
+	var v testConflict
+	if err := Unmarshal([]byte{0xA1, 0x84, 0x4E, 0x61, 0x6D, 0x65, 0x81, 0x6E}, &v); err != nil {
+		t.Error(err)
+	} else if v.Inner == nil || v.Inner.Name != "n" {
+		t.Errorf("embedded pointer should be allocated, got %+v", v.Inner)
+	}
+
+	var u testUnexportedPtr
+	if err := Unmarshal([]byte{0xA1, 0x86, 0x54, 0x61, 0x67, 0x67, 0x65, 0x64, 0x81, 0x6E}, &u); err == nil {
+		t.Error("error should not be nil when an embedded pointer to an unexported type must be allocated.")
+	}
+}
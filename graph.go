@@ -0,0 +1,95 @@
+package packstream
+
+// Signatures of the Neo4j graph structures.
+const (
+	SigNode                = 0x4E
+	SigRelationship        = 0x52
+	SigUnboundRelationship = 0x72
+	SigPath                = 0x50
+)
+
+func init() {
+	RegisterStructure(SigNode, Node{})
+	RegisterStructure(SigRelationship, Relationship{})
+	RegisterStructure(SigUnboundRelationship, UnboundRelationship{})
+	RegisterStructure(SigPath, Path{})
+}
+
+// Node is a Neo4j node.
+type Node struct {
+	ID         int64
+	Labels     []string
+	Properties map[string]interface{}
+}
+
+// Relationship is a Neo4j relationship, from the node StartID to the node EndID.
+type Relationship struct {
+	ID         int64
+	StartID    int64
+	EndID      int64
+	Type       string
+	Properties map[string]interface{}
+}
+
+// UnboundRelationship is a Neo4j relationship without its nodes, as found in paths.
+type UnboundRelationship struct {
+	ID         int64
+	Type       string
+	Properties map[string]interface{}
+}
+
+/*
+Path is a Neo4j path, as encoded in packstream.
+
+Nodes and Relationships hold the distinct nodes and relationships of the path, the first node being the start of the
+path. Sequence holds pairs of indices, one pair for each segment of the path: the index of the relationship in
+Relationships, starting from 1 and negated if the relationship is traversed backwards, followed by the index of the
+end node of the segment in Nodes. Segments reconstructs the segments in order.
+*/
+type Path struct {
+	Nodes         []Node
+	Relationships []UnboundRelationship
+	Sequence      []int64
+}
+
+// Segment is a segment of a path: a relationship between two nodes, traversed from Start to End.
+type Segment struct {
+	Start        Node
+	Relationship Relationship
+	End          Node
+}
+
+// Segments returns the segments of the path, in order. The relationships are bound to their nodes according to the
+// direction in which they are traversed.
+// It returns ErrInvalidPath if the sequence of the path is not consistent with its nodes and relationships.
+func (p Path) Segments() ([]Segment, error) {
+	if len(p.Sequence)%2 != 0 || (len(p.Nodes) == 0 && len(p.Sequence) != 0) {
+		return nil, ErrInvalidPath
+	}
+
+	segments := make([]Segment, 0, len(p.Sequence)/2)
+	for i := 0; i < len(p.Sequence); i += 2 {
+		var start Node
+		if i == 0 {
+			start = p.Nodes[0]
+		} else {
+			start = segments[len(segments)-1].End
+		}
+
+		ri, ni := p.Sequence[i], p.Sequence[i+1]
+		if ri < 0 {
+			ri = -ri
+		}
+		if ri == 0 || ri > int64(len(p.Relationships)) || ni < 0 || ni >= int64(len(p.Nodes)) {
+			return nil, ErrInvalidPath
+		}
+		end, ur := p.Nodes[ni], p.Relationships[ri-1]
+
+		r := Relationship{ID: ur.ID, StartID: start.ID, EndID: end.ID, Type: ur.Type, Properties: ur.Properties}
+		if p.Sequence[i] < 0 {
+			r.StartID, r.EndID = end.ID, start.ID
+		}
+		segments = append(segments, Segment{Start: start, Relationship: r, End: end})
+	}
+	return segments, nil
+}
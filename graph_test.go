@@ -0,0 +1,95 @@
+package packstream
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshal_Node(t *testing.T) {
+	var v interface{}
+	encoded := []byte{0xB3, 0x4E, 0x01, 0x91, 0x86, 0x50, 0x65, 0x72, 0x73, 0x6F, 0x6E, 0xA1, 0x84, 0x6E, 0x61, 0x6D,
+		0x65, 0x83, 0x42, 0x6F, 0x62}
+	expected := Node{ID: 1, Labels: []string{"Person"}, Properties: map[string]interface{}{"name": "Bob"}}
+
+	if err := Unmarshal(encoded, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, expected) {
+		t.Errorf("invalid decoded node, got %#v, expected %#v", v, expected)
+	}
+	if b, err := Marshal(expected); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(b, encoded) {
+		t.Errorf("invalid encoded node, got % #X, expected % #X", b, encoded)
+	}
+}
+
+func TestUnmarshal_Relationship(t *testing.T) {
+	var v interface{}
+	rel := Relationship{ID: 10, StartID: 1, EndID: 2, Type: "KNOWS", Properties: map[string]interface{}{}}
+	unbound := UnboundRelationship{ID: 10, Type: "KNOWS", Properties: map[string]interface{}{}}
+
+	if b, err := Marshal(rel); err != nil {
+		t.Error(err)
+	} else if b[0] != 0xB5 || b[1] != SigRelationship {
+		t.Errorf("invalid relationship header, got % #X", b[:2])
+	} else if err := Unmarshal(b, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, rel) {
+		t.Errorf("invalid decoded relationship, got %#v", v)
+	}
+
+	if b, err := Marshal(unbound); err != nil {
+		t.Error(err)
+	} else if b[0] != 0xB3 || b[1] != SigUnboundRelationship {
+		t.Errorf("invalid unbound relationship header, got % #X", b[:2])
+	} else if err := Unmarshal(b, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, unbound) {
+		t.Errorf("invalid decoded unbound relationship, got %#v", v)
+	}
+}
+
+func TestPath_Segments(t *testing.T) {
+	a := Node{ID: 1, Labels: []string{"N"}, Properties: map[string]interface{}{}}
+	b := Node{ID: 2, Labels: []string{"N"}, Properties: map[string]interface{}{}}
+	c := Node{ID: 3, Labels: []string{"N"}, Properties: map[string]interface{}{}}
+	knows := UnboundRelationship{ID: 10, Type: "KNOWS", Properties: map[string]interface{}{}}
+	likes := UnboundRelationship{ID: 11, Type: "LIKES", Properties: map[string]interface{}{}}
+
+	// (a)-[:KNOWS]->(b)<-[:LIKES]-(c)-[:KNOWS]->(b)
+	path := Path{
+		Nodes:         []Node{a, b, c},
+		Relationships: []UnboundRelationship{knows, likes},
+		Sequence:      []int64{1, 1, -2, 2, 1, 1},
+	}
+
+	var v interface{}
+	if p, err := Marshal(path); err != nil {
+		t.Fatal(err)
+	} else if err := Unmarshal(p, &v); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, path) {
+		t.Fatalf("invalid decoded path, got %#v", v)
+	}
+
+	expected := []Segment{
+		{Start: a, Relationship: Relationship{ID: 10, StartID: 1, EndID: 2, Type: "KNOWS", Properties: knows.Properties}, End: b},
+		{Start: b, Relationship: Relationship{ID: 11, StartID: 3, EndID: 2, Type: "LIKES", Properties: likes.Properties}, End: c},
+		{Start: c, Relationship: Relationship{ID: 10, StartID: 3, EndID: 2, Type: "KNOWS", Properties: knows.Properties}, End: b},
+	}
+	if segments, err := v.(Path).Segments(); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(segments, expected) {
+		t.Errorf("invalid segments, got %+v, expected %+v", segments, expected)
+	}
+
+	if segments, err := (Path{Nodes: []Node{a}}).Segments(); err != nil || len(segments) != 0 {
+		t.Errorf("a single node path should have no segments, got %v, %v", segments, err)
+	}
+	for _, sequence := range [][]int64{{1}, {0, 1}, {3, 1}, {1, 3}, {-1, -1}} {
+		path.Sequence = sequence
+		if _, err := path.Segments(); err != ErrInvalidPath {
+			t.Errorf("error should be ErrInvalidPath for sequence %v, got %v", sequence, err)
+		}
+	}
+}
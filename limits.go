@@ -0,0 +1,144 @@
+package packstream
+
+import (
+	"io"
+)
+
+// maxPrealloc is the size above which strings and byte arrays read from a stream are grown as their bytes are read,
+// rather than allocated from their size header.
+const maxPrealloc = 64 * 1024
+
+// maxPreallocLen is the length above which lists read from a stream are grown as their elements are read, rather than
+// allocated from their size header.
+const maxPreallocLen = 4 * 1024
+
+// DecoderOptions limits the resources used to decode untrusted input. Decoding fails with ErrLimitExceeded as soon
+// as a limit is exceeded, before allocating memory for the offending value. A zero limit means no limit.
+//
+// DecoderOptions also selects whether the decoded strings and byte arrays alias the input of Unmarshal.
+type DecoderOptions struct {
+	// MaxDepth is the maximum nesting depth of lists, maps and structures.
+	MaxDepth int
+	// MaxContainerLength is the maximum number of elements of a list, entries of a map or fields of a structure.
+	MaxContainerLength int
+	// MaxStringLength is the maximum number of bytes of a string or a byte array.
+	MaxStringLength int
+	// MaxTotalBytes is the maximum number of bytes read to decode a value, by Decode, Skip or Unmarshal.
+	// The tokens read by the Read methods of a Decoder do not start a new value: their bytes are counted from the
+	// last call to Decode or Skip, or from the creation of the Decoder, so that the limit covers all the tokens read
+	// in between. Once it is exceeded, reading tokens fails until Decode or Skip is called.
+	MaxTotalBytes int64
+
+	// AliasBytes makes the byte arrays decoded into []byte or empty interface values alias the input of Unmarshal,
+	// instead of being copied. The input must then not be modified while the decoded values are in use.
+	AliasBytes bool
+	// AliasStrings makes the decoded strings alias the input of Unmarshal, using package unsafe, instead of being
+	// copied. The input must then not be modified while the decoded strings are in use, as strings are immutable.
+	AliasStrings bool
+}
+
+// NewDecoder returns a new decoder that reads from rd, within the limits of o.
+func (o DecoderOptions) NewDecoder(rd io.Reader) *Decoder {
+	return &Decoder{&decodeState{stream: rd, opts: o}}
+}
+
+// Unmarshal is like Unmarshal, within the limits of o.
+func (o DecoderOptions) Unmarshal(data []byte, v interface{}) error {
+	dec := decodeState{bytes: data, opts: o}
+	return dec.unmarshal(v)
+}
+
+// limitedReader reads at most n bytes from r, and then returns ErrLimitExceeded.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	if l.n <= 0 {
+		return 0, ErrLimitExceeded
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	return
+}
+
+// begin resets the state of d before decoding a new top level value. The values decoded by a StreamUnmarshaler are
+// part of the value being decoded.
+func (d *decodeState) begin() {
+	if d.nested > 0 {
+		return
+	}
+	d.eos = false
+	d.path = d.path[:0]
+	d.depth = 0
+	d.base = d.cursor
+	if d.peeked {
+		d.base--
+	}
+}
+
+// checkRead checks that s more bytes can be read from the input.
+func (d *decodeState) checkRead(s uint64) error {
+	if d.opts.MaxTotalBytes > 0 && d.cursor-d.base+s > uint64(d.opts.MaxTotalBytes) {
+		return ErrLimitExceeded
+	}
+	return nil
+}
+
+// remaining returns the number of bytes which can still be read from the input, or -1 if it is unlimited.
+func (d *decodeState) remaining() int64 {
+	if d.opts.MaxTotalBytes <= 0 {
+		return -1
+	}
+	return d.opts.MaxTotalBytes - int64(d.cursor-d.base)
+}
+
+// checkDepth enters a nested list, map or structure. It must be followed by a call to d.leave.
+func (d *decodeState) checkDepth() error {
+	if d.opts.MaxDepth > 0 && d.depth >= d.opts.MaxDepth {
+		return ErrLimitExceeded
+	}
+	d.depth++
+	return nil
+}
+
+// leave leaves a nested list, map or structure.
+func (d *decodeState) leave() {
+	d.depth--
+}
+
+// checkContainer checks the size s of a container whose items are made of n values. Each value takes at least a
+// byte, so that s cannot exceed the remaining input, nor the bytes which can still be read.
+func (d *decodeState) checkContainer(s uint64, n uint64) error {
+	if d.opts.MaxContainerLength > 0 && s > uint64(d.opts.MaxContainerLength) {
+		return ErrLimitExceeded
+	}
+	if r := d.remaining(); r >= 0 && s*n > uint64(r) {
+		return ErrLimitExceeded
+	}
+	if d.stream == nil && s*n > uint64(len(d.bytes))-d.cursor {
+		return io.EOF
+	}
+	return nil
+}
+
+// preallocLen returns the length to allocate for a list of s elements. In stream mode, the size header is not
+// trusted beyond maxPreallocLen elements.
+func (d *decodeState) preallocLen(s uint64) int {
+	if d.stream != nil && s > maxPreallocLen {
+		return maxPreallocLen
+	}
+	return int(s)
+}
+
+// checkString checks the size s of a string or a byte array.
+func (d *decodeState) checkString(s uint64) error {
+	if d.opts.MaxStringLength > 0 && s > uint64(d.opts.MaxStringLength) {
+		return ErrLimitExceeded
+	}
+	return nil
+}
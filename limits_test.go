@@ -0,0 +1,208 @@
+package packstream
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoderOptions_MaxContainerLength(t *testing.T) {
+	var v interface{}
+	opts := DecoderOptions{MaxContainerLength: 2}
+	encoded := []byte{mListSize32, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}
+
+	if err := Unmarshal(encoded, &v); err != io.EOF {
+		t.Errorf("a list larger than the input should fail with io.EOF, got %v", err)
+	}
+	if err := opts.NewDecoder(bytes.NewReader(encoded)).Decode(&v); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded, got %v", err)
+	}
+	if err := opts.Unmarshal([]byte{0xD7, 0x01, 0x02, 0x03, 0xDF}, &v); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for a streamed list, got %v", err)
+	}
+	if err := opts.Unmarshal([]byte{0xDB, 0x81, 0x61, 0x01, 0x81, 0x62, 0x02, 0x81, 0x63, 0x03, 0xDF}, &v); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for a streamed map, got %v", err)
+	}
+	if err := opts.Unmarshal([]byte{0xB3, 0x01, 0x01, 0x02, 0x03}, &v); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for a structure, got %v", err)
+	}
+	if err := opts.Unmarshal([]byte{0xD7, 0x01, 0x02, 0xDF}, &v); err != nil {
+		t.Errorf("a list within the limit should be decoded, got %v", err)
+	}
+	if err := opts.NewDecoder(bytes.NewReader([]byte{0xD7, 0x01, 0x02, 0x03, 0xDF})).Skip(); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded when skipping, got %v", err)
+	}
+}
+
+func TestDecoderOptions_MaxStringLength(t *testing.T) {
+	var (
+		s string
+		p []byte
+	)
+	opts := DecoderOptions{MaxStringLength: 3}
+	encoded := []byte{mStringSize32, 0x7F, 0xFF, 0xFF, 0xFF, 0x61}
+
+	if err := NewDecoder(bytes.NewReader(encoded)).Decode(&s); err != io.EOF {
+		t.Errorf("a string larger than the input should fail with io.EOF, got %v", err)
+	}
+	if err := opts.NewDecoder(bytes.NewReader(encoded)).Decode(&s); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded, got %v", err)
+	}
+	if err := opts.Unmarshal([]byte{mBytesSize8, 0x04, 0x01, 0x02, 0x03, 0x04}, &p); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for bytes, got %v", err)
+	}
+	if err := opts.Unmarshal([]byte{0x83, 0x61, 0x62, 0x63}, &s); err != nil || s != "abc" {
+		t.Errorf("a string within the limit should be decoded, got %v, %v", s, err)
+	}
+
+	var raw RawMessage
+	for _, encoded := range [][]byte{{0x91, 0x84, 0x61, 0x62, 0x63, 0x64}, {0xA1, 0x81, 0x61, 0xCC, 0x04, 0x01, 0x02, 0x03, 0x04}} {
+		if err := opts.Unmarshal(encoded, &raw); err != ErrLimitExceeded {
+			t.Errorf("error should be ErrLimitExceeded for the raw message % #X, got %v", encoded, err)
+		}
+	}
+
+	long := strings.Repeat("a", 2*maxPrealloc)
+	if b, err := Marshal(long); err != nil {
+		t.Error(err)
+	} else if err := NewDecoder(bytes.NewReader(b)).Decode(&s); err != nil || s != long {
+		t.Errorf("a long string should be decoded, got %v bytes, %v", len(s), err)
+	}
+}
+
+func TestDecoderOptions_MaxDepth(t *testing.T) {
+	var v interface{}
+	opts := DecoderOptions{MaxDepth: 10}
+	encoded := append(bytes.Repeat([]byte{0x91}, 11), 0x01)
+
+	if err := opts.Unmarshal(encoded, &v); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded, got %v", err)
+	}
+	if err := opts.NewDecoder(bytes.NewReader(encoded)).Skip(); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded when skipping, got %v", err)
+	}
+	if err := opts.Unmarshal(encoded[1:], &v); err != nil {
+		t.Errorf("a value within the limit should be decoded, got %v", err)
+	}
+
+	var raw RawMessage
+	if err := opts.Unmarshal(encoded, &raw); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for a raw message, got %v", err)
+	}
+	if err := opts.NewDecoder(bytes.NewReader(encoded)).Decode(&raw); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded when decoding a raw message, got %v", err)
+	}
+	if err := opts.NewDecoder(bytes.NewReader(encoded[1:])).Decode(&raw); err != nil || !bytes.Equal(raw, encoded[1:]) {
+		t.Errorf("a raw message within the limit should be decoded, got % #X, %v", raw, err)
+	}
+}
+
+// testDelegating decodes its value by delegating it to Decode.
+type testDelegating struct {
+	V interface{}
+}
+
+func (v *testDelegating) DecodePS(d *Decoder) error {
+	return d.Decode(&v.V)
+}
+
+func TestDecoderOptions_MaxDepth_StreamUnmarshaler(t *testing.T) {
+	// A container decoded through a StreamUnmarshaler is only counted once.
+	opts := DecoderOptions{MaxDepth: 2}
+	encoded := []byte{0x91, 0x92, 0x01, 0x02}
+	for _, dec := range []*Decoder{opts.NewDecoder(bytes.NewReader(encoded)), {&decodeState{bytes: encoded, opts: opts}}} {
+		var v []testDelegating
+		if err := dec.Decode(&v); err != nil {
+			t.Errorf("a value at the maximum depth should be decoded, got %v", err)
+		} else if !reflect.DeepEqual(v, []testDelegating{{[]interface{}{int64(1), int64(2)}}}) {
+			t.Errorf("invalid decoded value, got %#v", v)
+		}
+	}
+
+	var v []testDelegating
+	if err := opts.Unmarshal([]byte{0x91, 0x91, 0x91, 0x01}, &v); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded, got %v", err)
+	}
+}
+
+func TestDecoderOptions_MaxTotalBytes(t *testing.T) {
+	var (
+		v   interface{}
+		raw RawMessage
+	)
+	opts := DecoderOptions{MaxTotalBytes: 4}
+
+	if err := opts.Unmarshal([]byte{0x84, 0x61, 0x62, 0x63, 0x64}, &v); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded, got %v", err)
+	}
+	if err := opts.Unmarshal([]byte{0x94, 0x01, 0x02, 0x03, 0x04}, &raw); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for a raw message, got %v", err)
+	}
+
+	dec := opts.NewDecoder(bytes.NewReader([]byte{0x83, 0x61, 0x62, 0x63, 0x93, 0x01, 0x02, 0x03, 0x94, 0x01, 0x02, 0x03, 0x04}))
+	for i := 0; i < 2; i++ {
+		if err := dec.Decode(&v); err != nil {
+			t.Errorf("values within the limit should be decoded, got %v", err)
+		}
+	}
+	if err := dec.Decode(&raw); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for a raw message, got %v", err)
+	}
+
+	// The tokens read by the pull API are counted from the last call to Decode or Skip.
+	encoded := bytes.Repeat([]byte{mInt16, 0x01, 0x00}, 5)
+	dec = DecoderOptions{MaxTotalBytes: 10}.NewDecoder(bytes.NewReader(encoded))
+	for i := 0; i < 3; i++ {
+		if _, err := dec.ReadInt(); err != nil {
+			t.Errorf("tokens within the limit should be read, got %v", err)
+		}
+	}
+	if _, err := dec.ReadInt(); err != ErrLimitExceeded {
+		t.Errorf("error should be ErrLimitExceeded for tokens, got %v", err)
+	}
+	dec = DecoderOptions{MaxTotalBytes: 10}.NewDecoder(bytes.NewReader(encoded))
+	for i := 0; i < 3; i++ {
+		dec.ReadInt()
+	}
+	if err := dec.Decode(&v); err != nil {
+		t.Errorf("Decode should start a new value, got %v", err)
+	} else if n, err := dec.ReadInt(); err != nil || n != 256 {
+		t.Errorf("tokens should be counted from the last Decode, got %v, %v", n, err)
+	}
+
+	// The size of a container is bounded by the bytes which can still be read, before allocating it.
+	for _, encoded := range [][]byte{{mListSize32, 0x7F, 0xFF, 0xFF, 0xFF}, {mMapSize32, 0x7F, 0xFF, 0xFF, 0xFF}} {
+		if err := (DecoderOptions{MaxTotalBytes: 100}).NewDecoder(bytes.NewReader(encoded)).Decode(&v); err != ErrLimitExceeded {
+			t.Errorf("error should be ErrLimitExceeded for % #X, got %v", encoded, err)
+		}
+	}
+}
+
+func TestDecoder_LargeListHeader(t *testing.T) {
+	// Without limits, the size of a list read from a stream is not trusted to preallocate it.
+	var (
+		v  interface{}
+		is []int64
+	)
+	encoded := []byte{mListSize32, 0x7F, 0xFF, 0xFF, 0xFF, 0x01}
+	if err := NewDecoder(bytes.NewReader(encoded)).Decode(&v); err != io.EOF {
+		t.Errorf("a list larger than the input should fail with io.EOF, got %v", err)
+	}
+	if err := NewDecoder(bytes.NewReader(encoded)).Decode(&is); err != io.EOF {
+		t.Errorf("a list larger than the input should fail with io.EOF, got %v", err)
+	}
+
+	large := make([]int64, 3*maxPreallocLen)
+	for i := range large {
+		large[i] = int64(i)
+	}
+	if b, err := Marshal(large); err != nil {
+		t.Error(err)
+	} else if err := NewDecoder(bytes.NewReader(b)).Decode(&is); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(is, large) {
+		t.Errorf("a large list should be decoded, got %v elements", len(is))
+	}
+}
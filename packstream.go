@@ -19,6 +19,7 @@ import (
 	"io"
 	"math"
 	"reflect"
+	"time"
 )
 
 const (
@@ -75,6 +76,21 @@ var ErrUnMarshalTypeError = errors.New("marshal: inappropriate type")
 // ErrMarshalValueTooLarge is returned when encoding a value which is too large for packstream format.
 var ErrMarshalValueTooLarge = errors.New("marshal: value is too large for packstream encoding")
 
+// ErrNoStream is returned when ending a streamed list or map which has not been started.
+var ErrNoStream = errors.New("marshal: no streamed list or map to end")
+
+// ErrLimitExceeded is returned when decoding a value which exceeds one of the limits of DecoderOptions.
+var ErrLimitExceeded = errors.New("marshal: decoding limit exceeded")
+
+// ErrInvalidPath is returned when the sequence of a path does not match its nodes and relationships.
+var ErrInvalidPath = errors.New("marshal: invalid path sequence")
+
+// ErrTrailingData is returned when the encoding of a packstream value is followed by other bytes.
+var ErrTrailingData = errors.New("marshal: data after the encoded value")
+
+// ErrEmptyRawMessage is returned when encoding a RawMessage which is empty but not nil.
+var ErrEmptyRawMessage = errors.New("marshal: empty raw message")
+
 var (
 	// Packed sizes
 	tinyStringSizes   [][]byte
@@ -83,8 +99,25 @@ var (
 	tinyListSizes     [][]byte
 	packedUint8Sizes  [][]byte
 	packedUint16Sizes [][]byte
-	packedUint32Size  func(n uint32) []byte
 	structType        reflect.Type
+	timeType          reflect.Type
+)
+
+// TimeFormat is the packstream representation of time.Time values, used by an Encoder or a Decoder.
+type TimeFormat uint8
+
+// Representations of time.Time values.
+const (
+	// TimeUnixNano represents a time as an integer number of nanoseconds elapsed since January 1, 1970 UTC, the zero
+	// time being represented as 0. It is the default.
+	TimeUnixNano TimeFormat = iota
+	// TimeUnixMilli represents a time as an integer number of milliseconds elapsed since January 1, 1970 UTC, the
+	// zero time being represented as 0.
+	TimeUnixMilli
+	// TimeISO8601 represents a time as an ISO 8601 string, in the RFC 3339 format with nanoseconds.
+	TimeISO8601
+	// TimeStructure represents a time as a Neo4j DateTime structure.
+	TimeStructure
 )
 
 // Marshaler is the interface implemented by objects that can marshal themselves into packstream.
@@ -99,6 +132,23 @@ type Unmarshaler interface {
 	UnmarshalPS(byte, io.Reader) error
 }
 
+// StreamMarshaler is the interface implemented by objects that can marshal themselves into packstream by writing to
+// an Encoder, which can encode their nested values.
+//
+// EncodePS must write exactly one value. StreamMarshaler takes precedence over Marshaler.
+type StreamMarshaler interface {
+	EncodePS(*Encoder) error
+}
+
+// StreamUnmarshaler is the interface implemented by objects that can unmarshal themselves from a Decoder, which can
+// decode their nested values.
+//
+// DecodePS must read exactly one value, whose marker can be inspected with PeekKind. The Decoder keeps the path, the
+// depth and the limits of the value being decoded. StreamUnmarshaler takes precedence over Unmarshaler.
+type StreamUnmarshaler interface {
+	DecodePS(*Decoder) error
+}
+
 // Structure represents a packstream structure.
 type Structure struct {
 	Signature byte          // Signature is the structure signature.
@@ -107,6 +157,7 @@ type Structure struct {
 
 func init() {
 	structType = reflect.TypeOf(Structure{})
+	timeType = reflect.TypeOf(time.Time{})
 	tinyStringSizes = make([][]byte, mTinyStringEnd)
 	for i := mTinyStringStart; i <= mTinyStringEnd; i++ {
 		tinyStringSizes[i-mTinyStringStart] = []byte{byte(i)}
@@ -132,11 +183,6 @@ func init() {
 		packedUint16Sizes[i] = make([]byte, 2)
 		binary.BigEndian.PutUint16(packedUint16Sizes[i], uint16(i))
 	}
-	packedUint32Size = func(n uint32) []byte {
-		p := make([]byte, 4)
-		binary.BigEndian.PutUint32(p, n)
-		return p
-	}
 }
 
 // NewStructure returns a new structure with the given signature and optional fields.
@@ -22,6 +22,34 @@ func (v *marshaller) UnmarshalPS(byte, io.Reader) error {
 	return nil
 }
 
+// testPair is encoded as a list of its name and values, by calling back into the Encoder and the Decoder.
+type testPair struct {
+	Name   string
+	Values []int64
+}
+
+func (p testPair) EncodePS(e *Encoder) error {
+	if err := e.WriteListHeader(2); err != nil {
+		return err
+	}
+	if err := e.Encode(p.Name); err != nil {
+		return err
+	}
+	return e.Encode(p.Values)
+}
+
+func (p *testPair) DecodePS(d *Decoder) error {
+	if n, err := d.ReadListHeader(); err != nil {
+		return err
+	} else if n != 2 {
+		return ErrUnMarshalTypeError
+	}
+	if err := d.Decode(&p.Name); err != nil {
+		return err
+	}
+	return d.Decode(&p.Values)
+}
+
 var validTestValues = []testValue{
 	// Null values
 	{[]byte{mNull}, nil},
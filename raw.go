@@ -0,0 +1,62 @@
+package packstream
+
+import (
+	"bytes"
+	"io"
+)
+
+// RawMessage is a raw encoded packstream value.
+// It implements Marshaler and Unmarshaler and can be used to delay packstream decoding or to write pre-encoded
+// packstream verbatim.
+type RawMessage []byte
+
+// MarshalPS returns m as the packstream encoding of m. A nil RawMessage is encoded as null, and an empty one returns
+// ErrEmptyRawMessage, as it would not encode any value.
+func (m RawMessage) MarshalPS() ([]byte, error) {
+	if m == nil {
+		return []byte{mNull}, nil
+	} else if len(m) == 0 {
+		return nil, ErrEmptyRawMessage
+	}
+	return m, nil
+}
+
+// UnmarshalPS sets *m to a copy of the encoded value starting with marker, reading only the bytes of that value.
+func (m *RawMessage) UnmarshalPS(marker byte, rd io.Reader) error {
+	var b bytes.Buffer
+	b.WriteByte(marker)
+	d := &decodeState{stream: io.TeeReader(rd, &b), marker: marker}
+	if err := d.skip(); err != nil {
+		return err
+	}
+	*m = append((*m)[0:0], b.Bytes()...)
+	return nil
+}
+
+// unmarshalRaw sets *m to a copy of the encoded value of the current marker, skipping it within the limits of d.
+// The depth of a container has already been checked by d.value.
+func (d *decodeState) unmarshalRaw(m *RawMessage) (err error) {
+	skip := d.skip
+	if k := markerKind(d.marker); k == ListKind || k == MapKind || k == StructureKind {
+		skip = d.skipContainer
+	}
+
+	if d.stream == nil {
+		start := d.cursor - 1
+		if err = skip(); err == nil {
+			*m = append((*m)[0:0], d.bytes[start:d.cursor]...)
+		}
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(d.marker)
+	stream := d.stream
+	d.stream = io.TeeReader(stream, &b)
+	err = skip()
+	d.stream = stream
+	if err == nil {
+		*m = append((*m)[0:0], b.Bytes()...)
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package packstream
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testRawRecord struct {
+	ID     int64
+	Fields RawMessage
+	Other  *RawMessage
+}
+
+func TestRawMessage_MarshalPS(t *testing.T) {
+	raw := RawMessage{0x92, 0x01, 0x81, 0x61}
+	if b, err := Marshal(raw); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, raw) {
+		t.Errorf("invalid encoded raw message, got % #X, expected % #X", b, raw)
+	}
+
+	if b, err := Marshal(RawMessage(nil)); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, []byte{mNull}) {
+		t.Errorf("invalid encoded nil raw message, got % #X", b)
+	}
+
+	if _, err := Marshal([]interface{}{RawMessage{}, 1}); !errors.Is(err, ErrEmptyRawMessage) {
+		t.Errorf("encoding an empty raw message should fail, got %v", err)
+	}
+
+	res := []byte{0x92, 0x92, 0x01, 0x81, 0x61, 0x2A}
+	if b, err := Marshal([]interface{}{raw, 42}); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, res) {
+		t.Errorf("invalid encoded list, got % #X, expected % #X", b, res)
+	}
+}
+
+func TestRawMessage_UnmarshalPS(t *testing.T) {
+	var v testRawRecord
+
+	fields := []byte{0xD7, 0xA1, 0x81, 0x61, 0xB1, 0x2A, 0x01, 0x92, 0x01, 0x02, 0xDF}
+	encoded := []byte{0xA3, 0x82, 0x49, 0x44, 0x2A, 0x86, 0x46, 0x69, 0x65, 0x6C, 0x64, 0x73}
+	encoded = append(encoded, fields...)
+	encoded = append(encoded, 0x85, 0x4F, 0x74, 0x68, 0x65, 0x72, mNull)
+
+	if err := Unmarshal(encoded, &v); err != nil {
+		t.Error(err)
+	} else if v.ID != 42 || !bytes.Equal(v.Fields, fields) || v.Other != nil {
+		t.Errorf("invalid decoded raw message, got %+v", v)
+	}
+	if &v.Fields[0] == &encoded[12] {
+		t.Error("raw message should not alias the input")
+	}
+
+	v = testRawRecord{}
+	if err := NewDecoder(bytes.NewReader(encoded)).Decode(&v); err != nil {
+		t.Error(err)
+	} else if v.ID != 42 || !bytes.Equal(v.Fields, fields) || v.Other != nil {
+		t.Errorf("invalid decoded raw message, got %+v", v)
+	}
+
+	// Re-encoding writes the raw messages verbatim.
+	var m map[string]interface{}
+	if b, err := Marshal(v); err != nil {
+		t.Error(err)
+	} else if err := Unmarshal(b, &m); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(m["Fields"], []interface{}{map[string]interface{}{"a": Structure{Signature: 42, Fields: []interface{}{int64(1)}}}, []interface{}{int64(1), int64(2)}}) {
+		t.Errorf("invalid re-encoded raw message, got %v", m)
+	}
+
+	var raw RawMessage
+	if err := Unmarshal([]byte{mNull}, &raw); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(raw, []byte{mNull}) {
+		t.Errorf("null should be kept as a raw message, got % #X", raw)
+	}
+}
@@ -0,0 +1,471 @@
+package packstream
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Kind represents the kind of a packstream value.
+type Kind uint8
+
+// Kinds of packstream values, as reported by Decoder.PeekKind.
+const (
+	InvalidKind Kind = iota
+	NullKind
+	BoolKind
+	IntKind
+	FloatKind
+	StringKind
+	BytesKind
+	ListKind
+	MapKind
+	StructureKind
+	EndOfStreamKind
+)
+
+var kindNames = []string{
+	InvalidKind:     "invalid",
+	NullKind:        "null",
+	BoolKind:        "bool",
+	IntKind:         "int",
+	FloatKind:       "float",
+	StringKind:      "string",
+	BytesKind:       "bytes",
+	ListKind:        "list",
+	MapKind:         "map",
+	StructureKind:   "structure",
+	EndOfStreamKind: "end of stream",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return kindNames[InvalidKind]
+}
+
+// markerKind returns the kind of the value starting with the marker m.
+func markerKind(m byte) Kind {
+	switch {
+	case m >= mTinyStringStart && m <= mTinyStringEnd:
+		return StringKind
+	case m >= mTinyListStart && m <= mTinyListEnd:
+		return ListKind
+	case m >= mTinyMapStart && m <= mTinyMapEnd:
+		return MapKind
+	case m >= mTinyStructStart && m <= mTinyStructEnd:
+		return StructureKind
+	case minTinyInt <= int8(m):
+		return IntKind
+	}
+	switch m {
+	case mNull:
+		return NullKind
+	case mFalse, mTrue:
+		return BoolKind
+	case mInt8, mInt16, mInt32, mInt64:
+		return IntKind
+	case mFloat64:
+		return FloatKind
+	case mStringSize8, mStringSize16, mStringSize32:
+		return StringKind
+	case mBytesSize8, mBytesSize16, mBytesSize32:
+		return BytesKind
+	case mListSize8, mListSize16, mListSize32, mListSizeStream:
+		return ListKind
+	case mMapSize8, mMapSize16, mMapSize32, mMapSizeStream:
+		return MapKind
+	case mStructSize8, mStructSize16:
+		return StructureKind
+	case mEndOfStream:
+		return EndOfStreamKind
+	}
+	return InvalidKind
+}
+
+// PeekKind returns the kind of the next value, without consuming it.
+func (d *Decoder) PeekKind() (Kind, error) {
+	if err := d.peekMarker(); err != nil {
+		return InvalidKind, err
+	}
+	return markerKind(d.marker), nil
+}
+
+// ReadNull reads a null value.
+func (d *Decoder) ReadNull() error {
+	return d.consume(NullKind)
+}
+
+// ReadBool reads a boolean value.
+func (d *Decoder) ReadBool() (bool, error) {
+	if err := d.consume(BoolKind); err != nil {
+		return false, err
+	}
+	return d.marker == mTrue, nil
+}
+
+// ReadInt reads an integer value.
+func (d *Decoder) ReadInt() (int64, error) {
+	if err := d.consume(IntKind); err != nil {
+		return 0, err
+	}
+	return d.readInt()
+}
+
+// ReadFloat reads a float value.
+func (d *Decoder) ReadFloat() (float64, error) {
+	if err := d.consume(FloatKind); err != nil {
+		return 0, err
+	}
+	return d.readFloat()
+}
+
+// ReadString reads a string value.
+func (d *Decoder) ReadString() (string, error) {
+	if err := d.consume(StringKind); err != nil {
+		return "", err
+	}
+	p, err := d.readString()
+	return string(p), err
+}
+
+// ReadBytes reads a byte array value.
+func (d *Decoder) ReadBytes() ([]byte, error) {
+	if err := d.consume(BytesKind); err != nil {
+		return nil, err
+	}
+	p, err := d.readByteArray()
+	if err != nil || d.stream != nil {
+		return p, err
+	}
+	return append([]byte(nil), p...), nil
+}
+
+// ReadListHeader reads the header of a list, and returns its number of elements, which must then be read.
+//
+// If the list is streamed, it returns -1. The elements are then followed by an end of stream, which is reported by
+// PeekKind as EndOfStreamKind, or by More returning false, and must be read with ReadEndOfStream.
+func (d *Decoder) ReadListHeader() (int, error) {
+	if err := d.consume(ListKind); err != nil {
+		return 0, err
+	}
+	return streamedSize(d.readListSize())
+}
+
+// ReadMapHeader reads the header of a map, and returns its number of entries, which must then be read as a string
+// key followed by its value.
+//
+// If the map is streamed, it returns -1. The entries are then followed by an end of stream, which is reported by
+// PeekKind as EndOfStreamKind, or by More returning false, and must be read with ReadEndOfStream.
+func (d *Decoder) ReadMapHeader() (int, error) {
+	if err := d.consume(MapKind); err != nil {
+		return 0, err
+	}
+	return streamedSize(d.readMapSize())
+}
+
+// ReadStructHeader reads the header of a structure, and returns its number of fields, which must then be read,
+// and its signature.
+func (d *Decoder) ReadStructHeader() (int, byte, error) {
+	if err := d.consume(StructureKind); err != nil {
+		return 0, 0, err
+	}
+	s, sig, err := d.readStructHeader()
+	return int(s), sig, err
+}
+
+// ReadEndOfStream reads the end of a streamed list or map.
+func (d *Decoder) ReadEndOfStream() error {
+	return d.consume(EndOfStreamKind)
+}
+
+// Skip reads the next value and discards it, including all the elements of a list, map or structure, without
+// allocating them. It returns ErrUnMarshalTypeError at the end of a streamed list or map.
+func (d *Decoder) Skip() error {
+	if err := d.peekMarker(); err != nil {
+		return err
+	} else if d.marker == mEndOfStream {
+		return ErrUnMarshalTypeError
+	}
+	d.begin()
+	return d.skipValue()
+}
+
+// streamedSize converts the size of a container to an int, using -1 for streamed containers.
+func streamedSize(s uint64, isStream bool, err error) (int, error) {
+	if isStream {
+		return -1, err
+	}
+	return int(s), err
+}
+
+// peekMarker reads the next marker, which is kept for the next call to readMarker.
+func (d *decodeState) peekMarker() error {
+	if d.peeked {
+		return nil
+	}
+	if err := d.readMarker(); err != nil {
+		return err
+	}
+	d.peeked = true
+	return nil
+}
+
+// consume reads the next marker, and checks that it starts a value of the kind k.
+// If it does not, the marker is kept for the next read, and ErrUnMarshalTypeError is returned.
+func (d *decodeState) consume(k Kind) error {
+	if err := d.peekMarker(); err != nil {
+		return err
+	}
+	if markerKind(d.marker) != k {
+		return ErrUnMarshalTypeError
+	}
+	d.peeked = false
+	return nil
+}
+
+// readInt reads the integer of the current marker.
+func (d *decodeState) readInt() (v int64, err error) {
+	var p []byte
+
+	switch {
+	case minTinyInt <= int8(d.marker):
+		v = int64(int8(d.marker))
+	case d.marker == mInt8:
+		if p, err = d.readFixed(1); err != nil {
+			return
+		}
+		v = int64(int8(p[0]))
+	case d.marker == mInt16:
+		if p, err = d.readFixed(2); err != nil {
+			return
+		}
+		v = int64(int16(binary.BigEndian.Uint16(p)))
+	case d.marker == mInt32:
+		if p, err = d.readFixed(4); err != nil {
+			return
+		}
+		v = int64(int32(binary.BigEndian.Uint32(p)))
+	case d.marker == mInt64:
+		if p, err = d.readFixed(8); err != nil {
+			return
+		}
+		v = int64(binary.BigEndian.Uint64(p))
+	}
+	return
+}
+
+// readFloat reads the float of the current marker.
+func (d *decodeState) readFloat() (f float64, err error) {
+	var p []byte
+	if p, err = d.readFixed(8); err != nil {
+		return
+	}
+	f = math.Float64frombits(binary.BigEndian.Uint64(p))
+	return
+}
+
+// readString reads the bytes of the string of the current marker.
+func (d *decodeState) readString() ([]byte, error) {
+	s, err := d.readStringSize()
+	if err != nil {
+		return nil, err
+	}
+	return d.readBytes(s)
+}
+
+// readStringSize reads the size of the string of the current marker.
+func (d *decodeState) readStringSize() (uint64, error) {
+	s, _, err := d.readHeaderSize(mTinyStringStart, mStringSize8, mStringSize16, mStringSize32, 0)
+	if err == nil {
+		err = d.checkString(s)
+	}
+	return s, err
+}
+
+// readByteArray reads the byte array of the current marker.
+func (d *decodeState) readByteArray() ([]byte, error) {
+	s, err := d.readByteArraySize()
+	if err != nil {
+		return nil, err
+	}
+	return d.readBytes(s)
+}
+
+// readByteArraySize reads the size of the byte array of the current marker.
+func (d *decodeState) readByteArraySize() (uint64, error) {
+	s, _, err := d.readHeaderSize(0, mBytesSize8, mBytesSize16, mBytesSize32, 0)
+	if err == nil {
+		err = d.checkString(s)
+	}
+	return s, err
+}
+
+// readListSize reads the size of the list of the current marker.
+func (d *decodeState) readListSize() (s uint64, isStream bool, err error) {
+	s, isStream, err = d.readHeaderSize(mTinyListStart, mListSize8, mListSize16, mListSize32, mListSizeStream)
+	if err == nil {
+		err = d.checkContainer(s, 1)
+	}
+	return
+}
+
+// readMapSize reads the size of the map of the current marker.
+func (d *decodeState) readMapSize() (s uint64, isStream bool, err error) {
+	s, isStream, err = d.readHeaderSize(mTinyMapStart, mMapSize8, mMapSize16, mMapSize32, mMapSizeStream)
+	if err == nil {
+		err = d.checkContainer(s, 2)
+	}
+	return
+}
+
+// readStructHeader reads the size and the signature of the structure of the current marker.
+func (d *decodeState) readStructHeader() (s uint64, sig byte, err error) {
+	var p []byte
+	if s, _, err = d.readHeaderSize(mTinyStructStart, mStructSize8, mStructSize16, 0, 0); err != nil {
+		return
+	}
+	if err = d.checkContainer(s, 1); err != nil {
+		return
+	}
+	if p, err = d.readFixed(1); err != nil {
+		return
+	}
+	sig = p[0]
+	return
+}
+
+// readHeaderSize reads the size of the sized value of the current marker: the low nibble of a tiny marker, or the
+// 8, 16 or 32 bits following the m8, m16 or m32 marker. A zero tiny, m32 or stream marker means that the value has
+// no such representation. isStream is true if the current marker is the stream marker.
+func (d *decodeState) readHeaderSize(tiny, m8, m16, m32, stream byte) (s uint64, isStream bool, err error) {
+	switch {
+	case tiny != 0 && d.marker&0xF0 == tiny:
+		s = uint64(d.marker & 0x0F)
+	case d.marker == m8:
+		s, err = d.readSize(1)
+	case d.marker == m16:
+		s, err = d.readSize(2)
+	case m32 != 0 && d.marker == m32:
+		s, err = d.readSize(4)
+	case stream != 0 && d.marker == stream:
+		isStream = true
+	}
+	return
+}
+
+// skipValue reads the next marker, and skips its value.
+func (d *decodeState) skipValue() error {
+	if err := d.readMarker(); err != nil {
+		return err
+	}
+	return d.skip()
+}
+
+// skip advances over the value of the current marker, reading only markers and sizes. An end of stream marker sets
+// d.eos.
+func (d *decodeState) skip() error {
+	switch markerKind(d.marker) {
+	case NullKind, BoolKind:
+		return nil
+	case IntKind:
+		return d.skipBytes(intSize(d.marker))
+	case FloatKind:
+		return d.skipBytes(8)
+	case StringKind:
+		s, err := d.readStringSize()
+		if err != nil {
+			return err
+		}
+		return d.skipBytes(s)
+	case BytesKind:
+		s, err := d.readByteArraySize()
+		if err != nil {
+			return err
+		}
+		return d.skipBytes(s)
+	case ListKind, MapKind, StructureKind:
+		if err := d.checkDepth(); err != nil {
+			return err
+		}
+		err := d.skipContainer()
+		d.leave()
+		return err
+	case EndOfStreamKind:
+		d.eos = true
+		return nil
+	}
+	return ErrUnMarshalTypeError
+}
+
+// skipContainer skips the list, map or structure of the current marker.
+func (d *decodeState) skipContainer() error {
+	switch markerKind(d.marker) {
+	case ListKind:
+		s, isStream, err := d.readListSize()
+		if err != nil {
+			return err
+		} else if isStream {
+			return d.skipStream(1)
+		}
+		return d.skipValues(s)
+	case MapKind:
+		s, isStream, err := d.readMapSize()
+		if err != nil {
+			return err
+		} else if isStream {
+			return d.skipStream(2)
+		}
+		return d.skipValues(2 * s)
+	}
+	s, _, err := d.readStructHeader()
+	if err != nil {
+		return err
+	}
+	return d.skipValues(s)
+}
+
+// intSize returns the number of bytes following the integer marker m.
+func intSize(m byte) uint64 {
+	switch m {
+	case mInt8:
+		return 1
+	case mInt16:
+		return 2
+	case mInt32:
+		return 4
+	case mInt64:
+		return 8
+	}
+	return 0
+}
+
+// skipValues skips the n next values.
+func (d *decodeState) skipValues(n uint64) error {
+	for ; n > 0; n-- {
+		if err := d.skipValue(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipStream skips the items of a streamed container up to its end of stream marker, each item being made of n
+// values.
+func (d *decodeState) skipStream(n uint64) error {
+	for i := 0; ; i++ {
+		if d.opts.MaxContainerLength > 0 && i > d.opts.MaxContainerLength {
+			return ErrLimitExceeded
+		}
+		if err := d.readMarker(); err != nil {
+			return err
+		} else if d.marker == mEndOfStream {
+			return nil
+		} else if err = d.skip(); err != nil {
+			return err
+		}
+		if err := d.skipValues(n - 1); err != nil {
+			return err
+		}
+	}
+}
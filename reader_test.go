@@ -0,0 +1,166 @@
+package packstream
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMarkerKind(t *testing.T) {
+	kinds := map[Kind]interface{}{
+		NullKind:      nil,
+		BoolKind:      true,
+		IntKind:       int64(-42),
+		FloatKind:     1.1,
+		StringKind:    "hello",
+		BytesKind:     []byte{1},
+		ListKind:      []interface{}{1},
+		MapKind:       map[string]interface{}{},
+		StructureKind: Structure{Signature: 42},
+	}
+	for k, v := range kinds {
+		if b, err := Marshal(v); err != nil {
+			t.Error(err)
+		} else if kind := markerKind(b[0]); kind != k {
+			t.Errorf("invalid kind for %v, got %v, expected %v", v, kind, k)
+		}
+	}
+	if kind := markerKind(mEndOfStream); kind != EndOfStreamKind {
+		t.Errorf("invalid kind for end of stream, got %v", kind)
+	}
+	if kind := markerKind(0xC4); kind != InvalidKind {
+		t.Errorf("invalid kind for reserved marker, got %v", kind)
+	}
+}
+
+func TestDecoder_Read(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	enc.WriteStructHeader(3, 0x71)
+	enc.WriteListHeader(2)
+	enc.WriteInt(1000)
+	enc.WriteString("a")
+	enc.BeginMap()
+	enc.WriteString("k")
+	enc.WriteFloat(1.5)
+	enc.End()
+	enc.WriteBytes([]byte{1, 2})
+	enc.WriteBool(true)
+	enc.WriteNull()
+
+	dec := NewDecoder(&b)
+	if n, sig, err := dec.ReadStructHeader(); err != nil || n != 3 || sig != 0x71 {
+		t.Errorf("invalid structure header, got %v, %#X, %v", n, sig, err)
+	}
+	if n, err := dec.ReadListHeader(); err != nil || n != 2 {
+		t.Errorf("invalid list header, got %v, %v", n, err)
+	}
+	if kind, err := dec.PeekKind(); err != nil || kind != IntKind {
+		t.Errorf("invalid peeked kind, got %v, %v", kind, err)
+	}
+	if _, err := dec.ReadString(); err != ErrUnMarshalTypeError {
+		t.Errorf("reading a value of another kind should fail, got %v", err)
+	}
+	if i, err := dec.ReadInt(); err != nil || i != 1000 {
+		t.Errorf("invalid int, got %v, %v", i, err)
+	}
+	if s, err := dec.ReadString(); err != nil || s != "a" {
+		t.Errorf("invalid string, got %v, %v", s, err)
+	}
+	if n, err := dec.ReadMapHeader(); err != nil || n != -1 {
+		t.Errorf("invalid map header, got %v, %v", n, err)
+	}
+	if s, err := dec.ReadString(); err != nil || s != "k" {
+		t.Errorf("invalid map key, got %v, %v", s, err)
+	}
+	if f, err := dec.ReadFloat(); err != nil || f != 1.5 {
+		t.Errorf("invalid float, got %v, %v", f, err)
+	}
+	if err := dec.Skip(); err != ErrUnMarshalTypeError {
+		t.Errorf("skipping an end of stream should fail, got %v", err)
+	}
+	if err := dec.ReadEndOfStream(); err != nil {
+		t.Errorf("invalid end of stream: %v", err)
+	}
+	if p, err := dec.ReadBytes(); err != nil || !bytes.Equal(p, []byte{1, 2}) {
+		t.Errorf("invalid bytes, got %v, %v", p, err)
+	}
+	if v, err := dec.ReadBool(); err != nil || !v {
+		t.Errorf("invalid bool, got %v, %v", v, err)
+	}
+	if err := dec.ReadNull(); err != nil {
+		t.Errorf("invalid null: %v", err)
+	}
+	if _, err := dec.PeekKind(); err != io.EOF {
+		t.Errorf("error should be io.EOF at the end of the input, got %v", err)
+	}
+}
+
+func TestDecoder_Skip(t *testing.T) {
+	var (
+		b bytes.Buffer
+		v string
+	)
+	b.Write([]byte{0xB2, 0x2A, 0x91, 0x01, 0xA1, 0x81, 0x61, 0x02})
+	b.Write([]byte{0x81, 0x61})
+
+	dec := NewDecoder(&b)
+	if kind, err := dec.PeekKind(); err != nil || kind != StructureKind {
+		t.Errorf("invalid peeked kind, got %v, %v", kind, err)
+	}
+	if err := dec.Skip(); err != nil {
+		t.Error(err)
+	} else if err := dec.Decode(&v); err != nil {
+		t.Error(err)
+	} else if v != "a" {
+		t.Errorf("invalid value after skipped value, got %v", v)
+	}
+}
+
+func TestDecoder_Skip_Nested(t *testing.T) {
+	var v int64
+	encoded := []byte{0xD7, 0xA1, 0x81, 0x61, 0xDB, 0x81, 0x62, 0xD7, 0xDF, 0xDF, 0xB1, 0x2A, 0xC9, 0x01, 0x00,
+		0xCC, 0x02, 0x01, 0x02, 0xC1, 0x3F, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A, 0xDF, 0x2A}
+
+	dec := NewDecoder(bytes.NewReader(encoded))
+	if err := dec.Skip(); err != nil {
+		t.Error(err)
+	} else if err := dec.Decode(&v); err != nil {
+		t.Error(err)
+	} else if v != 42 {
+		t.Errorf("invalid value after skipped value, got %v", v)
+	}
+
+	dec = NewDecoder(bytes.NewReader([]byte{0x92, 0x01}))
+	if err := dec.Skip(); err != io.EOF {
+		t.Errorf("error should be io.EOF on truncated input, got %v", err)
+	}
+	dec = NewDecoder(bytes.NewReader([]byte{0xC4}))
+	if err := dec.Skip(); err != ErrUnMarshalTypeError {
+		t.Errorf("skipping a reserved marker should fail, got %v", err)
+	}
+}
+
+func TestDecoder_Skip_Allocs(t *testing.T) {
+	var (
+		rd  bytes.Reader
+		str = make([]byte, 10000)
+	)
+	v := []interface{}{map[string]interface{}{"a": Structure{Signature: 42, Fields: []interface{}{int64(1000), 1.5}}},
+		string(str), str, []interface{}{true, nil, int64(-1)}}
+	encoded, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(&rd)
+	allocs := testing.AllocsPerRun(100, func() {
+		rd.Reset(encoded)
+		if err := dec.Skip(); err != nil {
+			t.Error(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("skipping a value should not allocate, got %v allocations", allocs)
+	}
+}
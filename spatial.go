@@ -0,0 +1,35 @@
+package packstream
+
+// Signatures of the Neo4j spatial structures.
+const (
+	SigPoint2D = 0x58
+	SigPoint3D = 0x59
+)
+
+// Spatial reference system identifiers of the coordinate reference systems supported by Neo4j.
+const (
+	SRIDWGS84       = 4326 // WGS-84 geographic coordinates: longitude and latitude.
+	SRIDWGS843D     = 4979 // WGS-84 geographic coordinates: longitude, latitude and height.
+	SRIDCartesian   = 7203 // Cartesian coordinates in two dimensions.
+	SRIDCartesian3D = 9157 // Cartesian coordinates in three dimensions.
+)
+
+func init() {
+	RegisterStructure(SigPoint2D, Point2D{})
+	RegisterStructure(SigPoint3D, Point3D{})
+}
+
+// Point2D is a Neo4j point in two dimensions. As in the Bolt protocol, its SRID is its first structure field.
+type Point2D struct {
+	SRID int64
+	X    float64
+	Y    float64
+}
+
+// Point3D is a Neo4j point in three dimensions. As in the Bolt protocol, its SRID is its first structure field.
+type Point3D struct {
+	SRID int64
+	X    float64
+	Y    float64
+	Z    float64
+}
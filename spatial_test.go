@@ -0,0 +1,45 @@
+package packstream
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPoint(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		encoded []byte
+	}{
+		{Point2D{SRID: SRIDCartesian, X: 1, Y: -1.1}, []byte{0xB3, SigPoint2D, mInt16, 0x1C, 0x23,
+			mFloat64, 0x3F, 0xF0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			mFloat64, 0xBF, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A}},
+		{Point3D{SRID: SRIDWGS843D, X: 1, Y: -1.1, Z: 0}, []byte{0xB4, SigPoint3D, mInt16, 0x13, 0x73,
+			mFloat64, 0x3F, 0xF0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			mFloat64, 0xBF, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A,
+			mFloat64, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+	for i, test := range tests {
+		var v interface{}
+		if b, err := Marshal(test.value); err != nil {
+			t.Errorf("test %v: unexpected error: %v", i, err)
+		} else if !bytes.Equal(b, test.encoded) {
+			t.Errorf("test %v: got % #X, expected % #X", i, b, test.encoded)
+		} else if err := Unmarshal(b, &v); err != nil {
+			t.Errorf("test %v: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(v, test.value) {
+			t.Errorf("test %v: got %#v, expected %#v", i, v, test.value)
+		}
+	}
+
+	var p Point2D
+	if err := Unmarshal(tests[0].encoded, &p); err != nil {
+		t.Error(err)
+	} else if p != tests[0].value {
+		t.Errorf("invalid decoded point, got %+v", p)
+	}
+	if err := Unmarshal(tests[1].encoded, &p); !errors.Is(err, ErrUnMarshalTypeError) {
+		t.Errorf("decoding a 3D point into a 2D point should fail, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package packstream
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Signer is the interface implemented by Go struct types which are encoded as packstream structures.
+//
+// Signature returns the signature of the structure. The exported fields of the Go struct are the structure fields,
+// in declaration order.
+type Signer interface {
+	Signature() byte
+}
+
+var (
+	signerType = reflect.TypeOf((*Signer)(nil)).Elem()
+
+	registryMu sync.RWMutex
+	sigTypes   = make(map[byte]reflect.Type)
+	typeSigs   = make(map[reflect.Type]byte)
+)
+
+/*
+RegisterStructure records the Go struct type of prototype as the type of the packstream structures with the given
+signature.
+
+Once registered, values of that type are encoded as structures with the given signature, and structures with
+that signature are decoded into values of that type when the target is an empty interface, instead of a Structure.
+Structures which do not fit that type, such as structures of another protocol version with more fields, are still
+decoded as a Structure. The exported fields of the Go struct are the structure fields, in declaration order.
+
+A type may be registered under several signatures, in which case it is encoded with the first one. It panics if
+prototype is not a struct or a pointer to a struct, or if the signature is already registered with another type.
+*/
+func RegisterStructure(signature byte, prototype interface{}) {
+	t := reflect.TypeOf(prototype)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("packstream: cannot register %v as a structure", t))
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if registered, ok := sigTypes[signature]; ok && registered != t {
+		panic(fmt.Sprintf("packstream: signature %#X is already registered with %v", signature, registered))
+	}
+	sigTypes[signature] = t
+	if _, ok := typeSigs[t]; !ok {
+		typeSigs[t] = signature
+		resetEncoderCache()
+	}
+}
+
+// registeredType returns the Go type registered with the given structure signature.
+func registeredType(signature byte) (t reflect.Type, ok bool) {
+	registryMu.RLock()
+	t, ok = sigTypes[signature]
+	registryMu.RUnlock()
+	return
+}
+
+// signatureOf returns the structure signature of the Go struct rv, either because its type has been registered or
+// because it implements Signer. It returns false if rv is not encoded as a structure.
+func signatureOf(rv reflect.Value) (byte, bool) {
+	t := rv.Type()
+	registryMu.RLock()
+	sig, ok := typeSigs[t]
+	registryMu.RUnlock()
+	if ok {
+		return sig, true
+	}
+
+	if t.Implements(signerType) {
+		return rv.Interface().(Signer).Signature(), true
+	}
+	if reflect.PtrTo(t).Implements(signerType) {
+		if !rv.CanAddr() {
+			v := reflect.New(t).Elem()
+			v.Set(rv)
+			rv = v
+		}
+		return rv.Addr().Interface().(Signer).Signature(), true
+	}
+	return 0, false
+}
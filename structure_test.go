@@ -0,0 +1,241 @@
+package packstream
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type testSigned struct {
+	Name   string
+	Values []int64
+	Skip   bool `packstream:"-"`
+}
+
+func (testSigned) Signature() byte {
+	return 0x01
+}
+
+type testRegistered struct {
+	ID int64
+}
+
+type testRegisteredUnmarshaler struct {
+	Marker byte
+	Data   []byte
+}
+
+func (v *testRegisteredUnmarshaler) UnmarshalPS(marker byte, rd io.Reader) (err error) {
+	v.Marker = marker
+	v.Data = make([]byte, 3)
+	_, err = io.ReadFull(rd, v.Data)
+	return
+}
+
+type testRegisteredStreamUnmarshaler struct {
+	Fields []string
+}
+
+func (v *testRegisteredStreamUnmarshaler) DecodePS(d *Decoder) error {
+	n, _, err := d.ReadStructHeader()
+	if err != nil {
+		return err
+	}
+	v.Fields = make([]string, n)
+	for i := range v.Fields {
+		if err = d.Decode(&v.Fields[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterStructure(0x02, testRegistered{})
+	RegisterStructure(0x03, &testRegisteredUnmarshaler{})
+	RegisterStructure(0x05, &testRegisteredStreamUnmarshaler{})
+}
+
+func TestRegisterStructure(t *testing.T) {
+	for _, prototype := range []interface{}{nil, 42, &Structure{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %v should panic.", prototype)
+				}
+			}()
+			RegisterStructure(0x02, prototype)
+		}()
+	}
+
+	// Registering the same type again is allowed.
+	RegisterStructure(0x02, &testRegistered{})
+	if typ, ok := registeredType(0x02); !ok || typ != reflect.TypeOf(testRegistered{}) {
+		t.Errorf("invalid registered type, got %v", typ)
+	}
+}
+
+func TestRegisterStructure_AfterEncoding(t *testing.T) {
+	type testLateRegistered struct {
+		ID int64
+	}
+	v := []testLateRegistered{{42}}
+
+	res := []byte{0x91, 0xA1, 0x82, 0x49, 0x44, 0x2A}
+	if b, err := Marshal(v); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, res) {
+		t.Errorf("invalid encoded map, got % #X, expected % #X", b, res)
+	}
+
+	// The encoding planned for the type is replaced once it is registered.
+	RegisterStructure(0x04, testLateRegistered{})
+	res = []byte{0x91, 0xB1, 0x04, 0x2A}
+	if b, err := Marshal(v); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, res) {
+		t.Errorf("invalid encoded structure, got % #X, expected % #X", b, res)
+	}
+}
+
+func TestMarshal_Signer(t *testing.T) {
+	res := []byte{0xB2, 0x01, 0x81, 0x61, 0x92, 0x01, 0x02}
+	if b, err := Marshal(testSigned{Name: "a", Values: []int64{1, 2}, Skip: true}); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, res) {
+		t.Errorf("invalid encoded structure, got % #X, expected % #X", b, res)
+	}
+
+	res = []byte{0xB1, 0x02, 0x2A}
+	if b, err := Marshal(&testRegistered{ID: 42}); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, res) {
+		t.Errorf("invalid encoded structure, got % #X, expected % #X", b, res)
+	}
+}
+
+func TestUnmarshal_Signer(t *testing.T) {
+	var (
+		v  testSigned
+		vi interface{}
+	)
+
+	if err := Unmarshal([]byte{0xB2, 0x01, 0x81, 0x61, 0x92, 0x01, 0x02}, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, testSigned{Name: "a", Values: []int64{1, 2}}) {
+		t.Errorf("invalid decoded structure, got %+v", v)
+	}
+
+	// Missing fields are set to zero values, additional ones are discarded.
+	if err := Unmarshal([]byte{0xB1, 0x01, 0x81, 0x62}, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, testSigned{Name: "b"}) {
+		t.Errorf("invalid decoded structure, got %+v", v)
+	}
+	if err := Unmarshal([]byte{0xB3, 0x01, 0x81, 0x63, 0x90, 0x91, 0xC0}, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, testSigned{Name: "c"}) {
+		t.Errorf("invalid decoded structure, got %+v", v)
+	}
+
+	if err := Unmarshal([]byte{0xB1, 0x02, 0x2A}, &v); err == nil {
+		t.Error("error should not be nil when the structure signature does not match.")
+	}
+
+	if err := Unmarshal([]byte{0xB1, 0x02, 0x2A}, &vi); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(vi, testRegistered{ID: 42}) {
+		t.Errorf("invalid decoded structure, got %#v", vi)
+	}
+
+	// Unregistered signatures are still decoded as Structure.
+	if err := Unmarshal([]byte{0xB1, 0x01, 0x2A}, &vi); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(vi, Structure{Signature: 0x01, Fields: []interface{}{int64(42)}}) {
+		t.Errorf("invalid decoded structure, got %#v", vi)
+	}
+}
+
+func TestUnmarshal_RegisteredUnmarshaler(t *testing.T) {
+	var vi interface{}
+
+	encoded := []byte{mStructSize8, 0x01, 0x03, 0x2A}
+	expected := testRegisteredUnmarshaler{Marker: mStructSize8, Data: []byte{0x01, 0x03, 0x2A}}
+	if err := Unmarshal(encoded, &vi); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(vi, expected) {
+		t.Errorf("invalid decoded structure, got %#v", vi)
+	}
+
+	vi = nil
+	if err := NewDecoder(bytes.NewReader(encoded)).Decode(&vi); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(vi, expected) {
+		t.Errorf("invalid decoded structure, got %#v", vi)
+	}
+}
+
+func TestUnmarshal_RegisteredStreamUnmarshaler(t *testing.T) {
+	encoded := []byte{0x92, mStructSize8, 0x02, 0x05, 0x81, 'a', 0x81, 'b', 0xB1, 0x05, 0x81, 'c'}
+	expected := []interface{}{
+		testRegisteredStreamUnmarshaler{Fields: []string{"a", "b"}},
+		testRegisteredStreamUnmarshaler{Fields: []string{"c"}},
+	}
+
+	var v []interface{}
+	if err := Unmarshal(encoded, &v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, expected) {
+		t.Errorf("invalid decoded structures, got %#v", v)
+	}
+
+	v = nil
+	if err := NewDecoder(bytes.NewReader(encoded)).Decode(&v); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(v, expected) {
+		t.Errorf("invalid decoded structures, got %#v", v)
+	}
+}
+
+func TestUnmarshal_RegisteredFallback(t *testing.T) {
+	// Structures which do not fit the type registered with their signature are decoded as Structure.
+	tests := []struct {
+		encoded  []byte
+		expected Structure
+	}{
+		// A Bolt 4.3 ROUTE message uses the signature of DateTime with a zone id.
+		{[]byte{0xB3, 0x66, 0xA0, 0x90, 0xC0}, Structure{Signature: 0x66,
+			Fields: []interface{}{map[string]interface{}{}, []interface{}{}, nil}}},
+		{[]byte{0xB1, 0x44, 0x81, 'x'}, Structure{Signature: 0x44, Fields: []interface{}{"x"}}},
+		// A Bolt 5 node has an element id.
+		{[]byte{0xB4, 0x4E, 0x01, 0x90, 0xA0, 0x81, '1'}, Structure{Signature: 0x4E,
+			Fields: []interface{}{int64(1), []interface{}{}, map[string]interface{}{}, "1"}}},
+		{[]byte{0xB1, 0x02, 0x81, 'x'}, Structure{Signature: 0x02, Fields: []interface{}{"x"}}},
+		{[]byte{0xB1, 0x05, 0x2A}, Structure{Signature: 0x05, Fields: []interface{}{int64(42)}}},
+	}
+
+	for _, tc := range tests {
+		expected := []interface{}{tc.expected, int64(1)}
+		encoded := append(append([]byte{0x92}, tc.encoded...), 0x01)
+
+		var v interface{}
+		if err := Unmarshal(encoded, &v); err != nil {
+			t.Errorf("% #X: %v", tc.encoded, err)
+		} else if !reflect.DeepEqual(v, expected) {
+			t.Errorf("invalid decoded value, got %#v, expected %#v", v, expected)
+		}
+
+		v = nil
+		dec := NewDecoder(bytes.NewReader(append(encoded, 0x02)))
+		if err := dec.Decode(&v); err != nil {
+			t.Errorf("% #X: %v", tc.encoded, err)
+		} else if !reflect.DeepEqual(v, expected) {
+			t.Errorf("invalid decoded value, got %#v, expected %#v", v, expected)
+		}
+		var i int64
+		if err := dec.Decode(&i); err != nil || i != 2 {
+			t.Errorf("invalid next value, got %v, %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package packstream
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Signatures of the Neo4j temporal structures.
+const (
+	SigDate           = 0x44
+	SigTime           = 0x54
+	SigLocalTime      = 0x74
+	SigDateTime       = 0x46
+	SigDateTimeZoneID = 0x66
+	SigLocalDateTime  = 0x64
+	SigDuration       = 0x45
+)
+
+const secondsPerDay = 24 * 60 * 60
+
+func init() {
+	RegisterStructure(SigDate, Date{})
+	RegisterStructure(SigTime, Time{})
+	RegisterStructure(SigLocalTime, LocalTime{})
+	RegisterStructure(SigDateTime, DateTime{})
+	RegisterStructure(SigDateTimeZoneID, DateTime{})
+	RegisterStructure(SigLocalDateTime, LocalDateTime{})
+	RegisterStructure(SigDuration, Duration{})
+}
+
+// Date is a Neo4j date, without time nor time zone.
+type Date struct {
+	Days int64 // Days is the number of days since the Unix epoch.
+}
+
+// DateOf returns the date of t, in the location of t.
+func DateOf(t time.Time) Date {
+	y, m, d := t.Date()
+	return Date{Days: time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / secondsPerDay}
+}
+
+// Time returns the midnight of d, in UTC.
+func (d Date) Time() time.Time {
+	return time.Unix(d.Days*secondsPerDay, 0).UTC()
+}
+
+// LocalTime is a Neo4j time of day, without time zone.
+type LocalTime struct {
+	Nanos int64 // Nanos is the number of nanoseconds since midnight.
+}
+
+// LocalTimeOf returns the time of day of t, in the location of t.
+func LocalTimeOf(t time.Time) LocalTime {
+	h, m, s := t.Clock()
+	return LocalTime{Nanos: int64(((h*60+m)*60+s)*1e9 + t.Nanosecond())}
+}
+
+// Time returns lt on January 1, 1970, in UTC.
+func (lt LocalTime) Time() time.Time {
+	return time.Unix(0, lt.Nanos).UTC()
+}
+
+// Time is a Neo4j time of day, with a time zone offset.
+type Time struct {
+	Nanos  int64 // Nanos is the number of nanoseconds since midnight, in local time.
+	Offset int64 // Offset is the time zone offset, in seconds east of UTC.
+}
+
+// TimeOf returns the time of day of t, with the offset of its location.
+func TimeOf(t time.Time) Time {
+	_, offset := t.Zone()
+	return Time{Nanos: LocalTimeOf(t).Nanos, Offset: int64(offset)}
+}
+
+// Time returns t on January 1, 1970, in a fixed zone with the offset of t.
+func (t Time) Time() time.Time {
+	return time.Date(1970, 1, 1, 0, 0, 0, int(t.Nanos), time.FixedZone("", int(t.Offset)))
+}
+
+// LocalDateTime is a Neo4j date and time, without time zone.
+type LocalDateTime struct {
+	Seconds int64 // Seconds is the number of seconds since the Unix epoch, in local time.
+	Nanos   int64 // Nanos is the number of nanoseconds within the second.
+}
+
+// LocalDateTimeOf returns the date and time of t, in the location of t.
+func LocalDateTimeOf(t time.Time) LocalDateTime {
+	_, offset := t.Zone()
+	return LocalDateTime{Seconds: t.Unix() + int64(offset), Nanos: int64(t.Nanosecond())}
+}
+
+// Time returns ldt in UTC.
+func (ldt LocalDateTime) Time() time.Time {
+	return time.Unix(ldt.Seconds, ldt.Nanos).UTC()
+}
+
+// Duration is a Neo4j duration. Unlike time.Duration, months and days do not have a fixed number of seconds.
+type Duration struct {
+	Months  int64
+	Days    int64
+	Seconds int64
+	Nanos   int64
+}
+
+// DurationOf returns the duration d, as seconds and nanoseconds.
+func DurationOf(d time.Duration) Duration {
+	s, ns := int64(d/time.Second), int64(d%time.Second)
+	if ns < 0 {
+		s--
+		ns += int64(time.Second)
+	}
+	return Duration{Seconds: s, Nanos: ns}
+}
+
+// AddTo returns t plus d: the months and days are added to the date of t, then the seconds and nanoseconds.
+func (d Duration) AddTo(t time.Time) time.Time {
+	return t.AddDate(0, int(d.Months), int(d.Days)).Add(time.Duration(d.Seconds)*time.Second + time.Duration(d.Nanos))
+}
+
+/*
+DateTime is a Neo4j date and time, with a time zone.
+
+It is encoded as a structure with the time zone id of its location if the location follows the rules of the time
+zone it is named after, as the locations loaded by time.LoadLocation, and with the offset of its location otherwise,
+as for the locations returned by time.FixedZone. Time zone ids are resolved with time.LoadLocation when decoding.
+*/
+type DateTime struct {
+	time.Time
+}
+
+// maxLocations is the maximum number of locations cached. It exceeds the number of time zones of the tz database,
+// while bounding the cache.
+const maxLocations = 1024
+
+var (
+	// locations caches the locations loaded by time.LoadLocation, as a map[string]*time.Location.
+	locations     sync.Map
+	locationCount int32
+)
+
+// loadLocation returns the location with the given name, loaded by time.LoadLocation. Only the locations which are
+// loaded are cached, so that arbitrary names cannot fill the cache.
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	if n := atomic.LoadInt32(&locationCount); n < maxLocations && atomic.CompareAndSwapInt32(&locationCount, n, n+1) {
+		if _, loaded := locations.LoadOrStore(name, loc); loaded {
+			atomic.AddInt32(&locationCount, -1)
+		}
+	}
+	return loc, nil
+}
+
+// zoneID returns the time zone id of the location of t, if its location follows the rules of that time zone at t.
+// A location may be named after a time zone without following its rules, such as time.FixedZone("CET", 3600).
+func zoneID(t time.Time) (string, bool) {
+	name := t.Location().String()
+	if name == "" || name == "UTC" || name == "Local" {
+		return "", false
+	}
+	loc, err := loadLocation(name)
+	if err != nil {
+		return "", false
+	}
+	lt := t.In(loc)
+	zone, offset := t.Zone()
+	lzone, loffset := lt.Zone()
+	start, end := t.ZoneBounds()
+	lstart, lend := lt.ZoneBounds()
+	return name, zone == lzone && offset == loffset && start.Equal(lstart) && end.Equal(lend)
+}
+
+// MarshalPS implements Marshaler.
+func (dt DateTime) MarshalPS() ([]byte, error) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	_, offset := dt.Zone()
+	seconds := dt.Unix() + int64(offset)
+
+	if id, ok := zoneID(dt.Time); ok {
+		enc.WriteStructHeader(3, SigDateTimeZoneID)
+		enc.WriteInt(seconds)
+		enc.WriteInt(int64(dt.Nanosecond()))
+		enc.WriteString(id)
+	} else {
+		enc.WriteStructHeader(3, SigDateTime)
+		enc.WriteInt(seconds)
+		enc.WriteInt(int64(dt.Nanosecond()))
+		enc.WriteInt(int64(offset))
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalPS implements Unmarshaler.
+func (dt *DateTime) UnmarshalPS(marker byte, rd io.Reader) (err error) {
+	var (
+		seconds, nanos, offset int64
+		id                     string
+	)
+	dec := &Decoder{&decodeState{stream: rd, marker: marker, peeked: true}}
+	s, sig, err := dec.ReadStructHeader()
+	if err != nil {
+		return
+	} else if s != 3 || (sig != SigDateTime && sig != SigDateTimeZoneID) {
+		return ErrUnMarshalTypeError
+	}
+	if seconds, err = dec.ReadInt(); err != nil {
+		return
+	}
+	if nanos, err = dec.ReadInt(); err != nil {
+		return
+	}
+
+	if sig == SigDateTime {
+		if offset, err = dec.ReadInt(); err != nil {
+			return
+		}
+		dt.Time = time.Unix(seconds-offset, nanos).In(time.FixedZone("", int(offset)))
+		return
+	}
+
+	if id, err = dec.ReadString(); err != nil {
+		return
+	}
+	loc, err := loadLocation(id)
+	if err != nil {
+		return
+	}
+	t := time.Unix(seconds, nanos).UTC()
+	dt.Time = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+	return
+}
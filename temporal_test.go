@@ -0,0 +1,132 @@
+package packstream
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestTemporal(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := time.Date(2018, 7, 14, 10, 30, 15, 500, paris)
+
+	tests := []struct {
+		value   interface{}
+		encoded []byte
+	}{
+		{DateOf(tm), []byte{0xB1, SigDate, mInt16, 0x45, 0x3E}},
+		{DateOf(time.Date(1969, 12, 31, 23, 0, 0, 0, time.UTC)), []byte{0xB1, SigDate, 0xFF}},
+		{LocalTimeOf(tm), []byte{0xB1, SigLocalTime, mInt64, 0x00, 0x00, 0x22, 0x64, 0x7D, 0xA4, 0x67, 0xF4}},
+		{TimeOf(tm), []byte{0xB2, SigTime, mInt64, 0x00, 0x00, 0x22, 0x64, 0x7D, 0xA4, 0x67, 0xF4, mInt16, 0x1C, 0x20}},
+		{LocalDateTimeOf(tm), []byte{0xB2, SigLocalDateTime, mInt32, 0x5B, 0x49, 0xD0, 0xB7, mInt16, 0x01, 0xF4}},
+		{Duration{Months: 14, Days: 3, Seconds: 61, Nanos: 1}, []byte{0xB4, SigDuration, 0x0E, 0x03, 0x3D, 0x01}},
+	}
+	for i, test := range tests {
+		var v interface{}
+		if b, err := Marshal(test.value); err != nil {
+			t.Errorf("test %v: unexpected error: %v", i, err)
+		} else if !bytes.Equal(b, test.encoded) {
+			t.Errorf("test %v: got % #X, expected % #X", i, b, test.encoded)
+		} else if err := Unmarshal(b, &v); err != nil {
+			t.Errorf("test %v: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(v, test.value) {
+			t.Errorf("test %v: got %#v, expected %#v", i, v, test.value)
+		}
+	}
+
+	if d := DateOf(tm).Time(); !d.Equal(time.Date(2018, 7, 14, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("invalid date time, got %v", d)
+	}
+	if lt := LocalTimeOf(tm).Time(); !lt.Equal(time.Date(1970, 1, 1, 10, 30, 15, 500, time.UTC)) {
+		t.Errorf("invalid local time, got %v", lt)
+	}
+	if tt := TimeOf(tm).Time(); !tt.Equal(time.Date(1970, 1, 1, 8, 30, 15, 500, time.UTC)) {
+		t.Errorf("invalid time, got %v", tt)
+	}
+	if ldt := LocalDateTimeOf(tm).Time(); !ldt.Equal(time.Date(2018, 7, 14, 10, 30, 15, 500, time.UTC)) {
+		t.Errorf("invalid local date time, got %v", ldt)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	if d := DurationOf(-1500 * time.Millisecond); d != (Duration{Seconds: -2, Nanos: 5e8}) {
+		t.Errorf("invalid duration, got %+v", d)
+	}
+	start := time.Date(2018, 1, 31, 0, 0, 0, 0, time.UTC)
+	if end := (Duration{Months: 1, Days: 1, Seconds: 60}).AddTo(start); !end.Equal(time.Date(2018, 3, 4, 0, 1, 0, 0, time.UTC)) {
+		t.Errorf("invalid time after duration, got %v", end)
+	}
+}
+
+func TestDateTime(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zoned := DateTime{time.Date(2018, 7, 14, 10, 30, 15, 500, paris)}
+	encoded := []byte{0xB3, SigDateTimeZoneID, mInt32, 0x5B, 0x49, 0xD0, 0xB7, mInt16, 0x01, 0xF4, 0x8C, 0x45, 0x75,
+		0x72, 0x6F, 0x70, 0x65, 0x2F, 0x50, 0x61, 0x72, 0x69, 0x73}
+	var v interface{}
+	if b, err := Marshal(zoned); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, encoded) {
+		t.Errorf("invalid encoded date time, got % #X, expected % #X", b, encoded)
+	} else if err := Unmarshal(b, &v); err != nil {
+		t.Error(err)
+	} else if dt, ok := v.(DateTime); !ok || !dt.Equal(zoned.Time) || dt.Location().String() != "Europe/Paris" {
+		t.Errorf("invalid decoded date time, got %v", v)
+	}
+
+	offset := DateTime{time.Date(2018, 7, 14, 10, 30, 15, 500, time.FixedZone("", -3600))}
+	encoded = []byte{0xB3, SigDateTime, mInt32, 0x5B, 0x49, 0xD0, 0xB7, mInt16, 0x01, 0xF4, mInt16, 0xF1, 0xF0}
+	var dt DateTime
+	if b, err := Marshal(offset); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, encoded) {
+		t.Errorf("invalid encoded date time, got % #X, expected % #X", b, encoded)
+	} else if err := NewDecoder(bytes.NewReader(b)).Decode(&dt); err != nil {
+		t.Error(err)
+	} else if _, o := dt.Zone(); !dt.Equal(offset.Time) || o != -3600 {
+		t.Errorf("invalid decoded date time, got %v", dt)
+	}
+
+	// A fixed zone named after a time zone is encoded with its offset, as it does not follow the rules of the zone.
+	for _, tm := range []time.Time{
+		time.Date(2018, 7, 14, 10, 30, 0, 0, time.FixedZone("CET", 3600)),
+		time.Date(2018, 1, 14, 10, 30, 0, 0, time.FixedZone("CET", 3600)),
+		time.Date(2018, 1, 14, 10, 30, 0, 0, time.FixedZone("Europe/Paris", 3600)),
+	} {
+		if b, err := Marshal(DateTime{tm}); err != nil {
+			t.Error(err)
+		} else if b[1] != SigDateTime {
+			t.Errorf("%v should be encoded with its offset, got % #X", tm, b)
+		}
+	}
+	// Other locations named after a time zone are encoded with their zone id.
+	if cet, err := time.LoadLocation("CET"); err != nil {
+		t.Fatal(err)
+	} else if b, err := Marshal(DateTime{time.Date(2018, 1, 14, 10, 30, 0, 0, cet)}); err != nil {
+		t.Error(err)
+	} else if b[1] != SigDateTimeZoneID {
+		t.Errorf("a loaded location should be encoded with its zone id, got % #X", b)
+	}
+
+	if err := Unmarshal([]byte{0xB3, SigDateTimeZoneID, 0x00, 0x00, 0x83, 0x61, 0x2F, 0x62}, &dt); err == nil {
+		t.Error("decoding an unknown time zone id should fail")
+	}
+	if _, ok := locations.Load("a/b"); ok {
+		t.Error("an unknown time zone id should not be cached")
+	} else if _, ok := locations.Load("Europe/Paris"); !ok {
+		t.Error("a loaded time zone should be cached")
+	}
+	if err := Unmarshal([]byte{0xB2, SigDateTime, 0x00, 0x00}, &dt); !errors.Is(err, ErrUnMarshalTypeError) {
+		t.Errorf("error should be ErrUnMarshalTypeError, got %v", err)
+	}
+}
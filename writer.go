@@ -0,0 +1,141 @@
+package packstream
+
+// WriteNull writes a packstream null.
+func (e *Encoder) WriteNull() error {
+	return e.done(e.writeMarker(mNull))
+}
+
+// WriteBool writes a packstream boolean.
+func (e *Encoder) WriteBool(b bool) error {
+	if b {
+		return e.done(e.writeMarker(mTrue))
+	}
+	return e.done(e.writeMarker(mFalse))
+}
+
+// WriteInt writes a packstream integer, using the smallest representation which can hold n.
+func (e *Encoder) WriteInt(n int64) error {
+	e.buf = AppendInt(e.buf, n)
+	return e.done(e.flushFull())
+}
+
+// WriteFloat writes a packstream float.
+func (e *Encoder) WriteFloat(f float64) error {
+	e.buf = AppendFloat(e.buf, f)
+	return e.done(e.flushFull())
+}
+
+// WriteString writes a packstream string.
+func (e *Encoder) WriteString(s string) (err error) {
+	if e.buf, err = AppendString(e.buf, s); err == nil {
+		err = e.flushFull()
+	}
+	return e.done(err)
+}
+
+// WriteBytes writes a packstream byte array.
+func (e *Encoder) WriteBytes(p []byte) (err error) {
+	if e.buf, err = AppendBytes(e.buf, p); err == nil {
+		err = e.flushFull()
+	}
+	return e.done(err)
+}
+
+// WriteListHeader writes the header of a list of n elements. It must be followed by the n elements.
+func (e *Encoder) WriteListHeader(n int) (err error) {
+	if e.buf, err = AppendListHeader(e.buf, n); err == nil {
+		err = e.flushFull()
+	}
+	return e.done(err)
+}
+
+// WriteMapHeader writes the header of a map of n entries. It must be followed by the n entries, each of them being
+// a string key followed by its value.
+func (e *Encoder) WriteMapHeader(n int) (err error) {
+	if e.buf, err = AppendMapHeader(e.buf, n); err == nil {
+		err = e.flushFull()
+	}
+	return e.done(err)
+}
+
+// WriteStructHeader writes the header of a structure of n fields, with the given signature. It must be followed by
+// the n fields.
+func (e *Encoder) WriteStructHeader(n int, sig byte) (err error) {
+	if e.buf, err = AppendStructHeader(e.buf, n, sig); err == nil {
+		err = e.flushFull()
+	}
+	return e.done(err)
+}
+
+// BeginList starts a streamed list, whose size is not known in advance. The list elements are then written by
+// calling Encode, and the list is terminated by calling End.
+func (e *Encoder) BeginList() (err error) {
+	if err = e.writeMarker(mListSizeStream); err == nil {
+		e.streams++
+	}
+	return e.done(err)
+}
+
+// BeginMap starts a streamed map, whose size is not known in advance. The map entries are then written by calling
+// Encode for each key, followed by its value, and the map is terminated by calling End.
+func (e *Encoder) BeginMap() (err error) {
+	if err = e.writeMarker(mMapSizeStream); err == nil {
+		e.streams++
+	}
+	return e.done(err)
+}
+
+// End terminates the innermost streamed list or map started by BeginList or BeginMap.
+// It returns ErrNoStream if there is no such list or map.
+func (e *Encoder) End() (err error) {
+	if e.streams == 0 {
+		return ErrNoStream
+	}
+	if err = e.writeMarker(mEndOfStream); err == nil {
+		e.streams--
+	}
+	return e.done(err)
+}
+
+// Flush writes the buffered bytes to the underlying writer. It does nothing for the encoders of Marshal and
+// AppendMarshal, which have no underlying writer.
+func (e *Encoder) Flush() (err error) {
+	if len(e.buf) > 0 && e.wr != nil {
+		_, err = e.wr.Write(e.buf)
+		e.buf = e.buf[:0]
+		e.start = 0
+	}
+	return
+}
+
+// done ends a call writing a value or a token, returning err. Unless e is buffered, or the call is part of the
+// encoding of a larger value, the buffered bytes are then written to the underlying writer.
+func (e *Encoder) done(err error) error {
+	if e.buffered || e.encoding {
+		return err
+	}
+	if flushErr := e.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// write appends p to the buffer of e.
+func (e *Encoder) write(p []byte) error {
+	e.buf = append(e.buf, p...)
+	return e.flushFull()
+}
+
+// flushFull flushes the buffer of e once it reaches the threshold of a buffered encoder.
+func (e *Encoder) flushFull() error {
+	if e.threshold > 0 && len(e.buf) >= e.threshold {
+		return e.Flush()
+	}
+	return nil
+}
+
+// writeMarker writes a single marker byte.
+func (e *Encoder) writeMarker(m byte) error {
+	e.buf = append(e.buf, m)
+	return e.flushFull()
+}
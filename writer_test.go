@@ -0,0 +1,68 @@
+package packstream
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestEncoder_Write(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+
+	tests := []struct {
+		write   func() error
+		encoded []byte
+	}{
+		{enc.WriteNull, []byte{mNull}},
+		{func() error { return enc.WriteBool(true) }, []byte{mTrue}},
+		{func() error { return enc.WriteBool(false) }, []byte{mFalse}},
+		{func() error { return enc.WriteInt(minTinyInt) }, []byte{0xF0}},
+		{func() error { return enc.WriteInt(math.MinInt8) }, []byte{mInt8, 0x80}},
+		{func() error { return enc.WriteInt(math.MaxInt16) }, []byte{mInt16, 0x7F, 0xFF}},
+		{func() error { return enc.WriteInt(math.MinInt32) }, []byte{mInt32, 0x80, 0x00, 0x00, 0x00}},
+		{func() error { return enc.WriteInt(math.MaxInt64) }, []byte{mInt64, 0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{func() error { return enc.WriteFloat(-1.1) }, []byte{mFloat64, 0xBF, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A}},
+		{func() error { return enc.WriteString("a") }, []byte{0x81, 0x61}},
+		{func() error { return enc.WriteBytes([]byte{1, 2, 3}) }, []byte{mBytesSize8, 0x03, 0x01, 0x02, 0x03}},
+		{func() error { return enc.WriteListHeader(1) }, []byte{0x91}},
+		{func() error { return enc.WriteListHeader(math.MaxUint8) }, []byte{mListSize8, 0xFF}},
+		{func() error { return enc.WriteMapHeader(math.MaxUint16) }, []byte{mMapSize16, 0xFF, 0xFF}},
+		{func() error { return enc.WriteMapHeader(math.MaxUint16 + 1) }, []byte{mMapSize32, 0x00, 0x01, 0x00, 0x00}},
+		{func() error { return enc.WriteStructHeader(2, 42) }, []byte{0xB2, 0x2A}},
+		{func() error { return enc.WriteStructHeader(maxInt4, 42) }, []byte{mStructSize8, 0x10, 0x2A}},
+	}
+	for i, test := range tests {
+		b.Reset()
+		if err := test.write(); err != nil {
+			t.Errorf("test %v: unexpected error: %v", i, err)
+		} else if !bytes.Equal(b.Bytes(), test.encoded) {
+			t.Errorf("test %v: got % #X, expected % #X", i, b.Bytes(), test.encoded)
+		}
+	}
+
+	if err := enc.WriteStructHeader(math.MaxUint16+1, 42); err != ErrMarshalValueTooLarge {
+		t.Errorf("error should be ErrMarshalValueTooLarge, got %v", err)
+	}
+	if err := enc.WriteListHeader(-1); err != ErrMarshalValueTooLarge {
+		t.Errorf("error should be ErrMarshalValueTooLarge, got %v", err)
+	}
+}
+
+func TestEncoder_Write_Allocs(t *testing.T) {
+	var b bytes.Buffer
+	b.Grow(64)
+	enc := NewEncoder(&b)
+	allocs := testing.AllocsPerRun(100, func() {
+		b.Reset()
+		enc.WriteMapHeader(1)
+		enc.WriteString("key")
+		enc.WriteListHeader(3)
+		enc.WriteInt(math.MaxInt32)
+		enc.WriteFloat(1.1)
+		enc.WriteBool(true)
+	})
+	if allocs != 0 {
+		t.Errorf("writing tokens should not allocate, got %v allocations", allocs)
+	}
+}